@@ -2,6 +2,7 @@ package main
 
 import (
 	"github.com/thoj/go-ircevent"
+	"crypto"
 	"crypto/tls"
 	"log"
 	"os"
@@ -18,7 +19,6 @@ const addr = "libera75jm6of4wxpxt4aynol3xjmbtxgfyjpu34ss4d7r7q2v5zrpyd.onion:669
 // $ go run simple-tor.go my-nick my-cert.pem my-key.pem
 
 func main() {
-	os.Setenv("ALL_PROXY", "socks5h://localhost:9050")
 	nick, certFile := os.Args[1], os.Args[2]
 	keyFile := certFile
 	if len(os.Args) == 4 {
@@ -28,6 +28,11 @@ func main() {
 	if err != nil {
 		log.Fatal(err)
 	}
+	fingerprint, err := irc.CertFingerprint(clientCert, crypto.SHA512)
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Println("Client certificate fingerprint for NickServ CERT ADD:", fingerprint)
 	ircnick1 := nick
 	irccon := irc.IRC(ircnick1, nick)
 	irccon.VerboseCallbackHandler = true
@@ -35,10 +40,16 @@ func main() {
 	irccon.SASLMech = "EXTERNAL"
 	irccon.Debug = true
 	irccon.UseTLS = true
+	irccon.Dialer = &irc.SOCKS5Dialer{Addr: "localhost:9050"}
 	irccon.TLSConfig = &tls.Config{
-		InsecureSkipVerify: true,
 		Certificates: []tls.Certificate{clientCert},
 	}
+	// The .onion certificate can't be verified, trust its key on first use
+	pins, err := irc.DefaultPinStore()
+	if err != nil {
+		log.Fatal(err)
+	}
+	irccon.CertPinning = &irc.CertPinning{Store: pins}
 	irccon.AddCallback("001", func(e *irc.Event) {})
 	irccon.AddCallback("376", func(e *irc.Event) {
 		log.Println("Quitting")
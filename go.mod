@@ -1,8 +1,9 @@
 module github.com/thoj/go-ircevent
 
-go 1.12
+go 1.15
 
 require (
+	golang.org/x/crypto v0.0.0-20210616213533-5ff15b29337e
 	golang.org/x/net v0.0.0-20210614182718-04defd469f4e
 	golang.org/x/text v0.3.6
 )
@@ -21,17 +21,18 @@ package irc
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"crypto/tls"
 	"errors"
 	"fmt"
 	"log"
 	"net"
+	"net/url"
 	"os"
 	"strconv"
 	"strings"
 	"time"
 
-	"golang.org/x/net/proxy"
 	"golang.org/x/text/encoding"
 )
 
@@ -80,11 +81,15 @@ func (irc *Connection) readLoop() {
 				irc.Log.Printf("<-- %s\n", strings.TrimSpace(msg))
 			}
 
+			received := time.Now()
 			irc.lastMessageMutex.Lock()
-			irc.lastMessage = time.Now()
+			irc.lastMessage = received
 			irc.lastMessageMutex.Unlock()
 			event, err := parseToEvent(msg)
 			if err == nil {
+				if event.Time.IsZero() {
+					event.Time = received
+				}
 				event.Connection = irc
 				irc.RunCallbacks(event)
 			}
@@ -95,12 +100,33 @@ func (irc *Connection) readLoop() {
 // Unescape tag values as defined in the IRCv3.2 message tags spec
 // http://ircv3.net/specs/core/message-tags-3.2.html
 func unescapeTagValue(value string) string {
-	value = strings.Replace(value, "\\:", ";", -1)
-	value = strings.Replace(value, "\\s", " ", -1)
-	value = strings.Replace(value, "\\\\", "\\", -1)
-	value = strings.Replace(value, "\\r", "\r", -1)
-	value = strings.Replace(value, "\\n", "\n", -1)
-	return value
+	if strings.IndexByte(value, '\\') == -1 {
+		return value
+	}
+	var b strings.Builder
+	for i := 0; i < len(value); i++ {
+		if value[i] != '\\' {
+			b.WriteByte(value[i])
+			continue
+		}
+		i++
+		if i == len(value) {
+			break // A trailing backslash is dropped
+		}
+		switch value[i] {
+		case ':':
+			b.WriteByte(';')
+		case 's':
+			b.WriteByte(' ')
+		case 'r':
+			b.WriteByte('\r')
+		case 'n':
+			b.WriteByte('\n')
+		default:
+			b.WriteByte(value[i])
+		}
+	}
+	return b.String()
 }
 
 //Parse raw irc messages
@@ -129,6 +155,10 @@ func parseToEvent(msg string) (*Event, error) {
 		} else {
 			return nil, errors.New("Malformed msg from server")
 		}
+		// IRCv3 server-time
+		if t, err := time.Parse(time.RFC3339Nano, event.Tags["time"]); err == nil {
+			event.Time = t
+		}
 	}
 
 	if msg[0] == ':' {
@@ -163,32 +193,46 @@ func (irc *Connection) writeLoop() {
 	defer irc.Done()
 	w := irc.Encoding.NewEncoder().Writer(irc.socket)
 	errChan := irc.ErrorChan()
+	limiter := newFloodLimiter(irc.FloodControl)
 	for {
-		select {
-		case <-irc.end:
-			return
-		case b, ok := <-irc.pwrite:
-			if !ok || b == "" || irc.socket == nil {
-				return
+		// Hold back if we are sending too fast
+		if limiter != nil {
+			if wait := limiter.wait(time.Now()); wait > 0 {
+				timer := time.NewTimer(wait)
+				select {
+				case <-timer.C:
+				case <-irc.end:
+					timer.Stop()
+					return
+				}
 			}
+		}
 
-			if irc.Debug {
-				irc.Log.Printf("--> %s\n", strings.TrimSpace(b))
-			}
+		b, ok := irc.nextLine()
+		if !ok || b == "" || irc.socket == nil {
+			return
+		}
 
-			// Set a write deadline based on the time out
-			irc.socket.SetWriteDeadline(time.Now().Add(irc.Timeout))
+		if limiter != nil {
+			limiter.charge(time.Now(), len(b))
+		}
 
-			_, err := w.Write([]byte(b))
+		if irc.Debug {
+			irc.Log.Printf("--> %s\n", strings.TrimSpace(b))
+		}
 
-			// Past blocking write, bin timeout
-			var zero time.Time
-			irc.socket.SetWriteDeadline(zero)
+		// Set a write deadline based on the time out
+		irc.socket.SetWriteDeadline(time.Now().Add(irc.Timeout))
 
-			if err != nil {
-				errChan <- err
-				return
-			}
+		_, err := w.Write([]byte(b))
+
+		// Past blocking write, bin timeout
+		var zero time.Time
+		irc.socket.SetWriteDeadline(zero)
+
+		if err != nil {
+			errChan <- err
+			return
 		}
 	}
 }
@@ -211,13 +255,7 @@ func (irc *Connection) pingLoop() {
 		case <-ticker2.C:
 			//Ping at the ping frequency
 			irc.SendRawf("PING %d", time.Now().UnixNano())
-			//Try to recapture nickname if it's not as configured.
-			irc.Lock()
-			if irc.nick != irc.nickcurrent {
-				irc.nickcurrent = irc.nick
-				irc.SendRawf("NICK %s", irc.nick)
-			}
-			irc.Unlock()
+			irc.recoverNick()
 		case <-irc.end:
 			ticker.Stop()
 			ticker2.Stop()
@@ -226,6 +264,17 @@ func (irc *Connection) pingLoop() {
 	}
 }
 
+// Try to recapture the nickname if it's not as configured. A nick which
+// differs only in case under the server's case mapping is ours already.
+func (irc *Connection) recoverNick() {
+	irc.Lock()
+	defer irc.Unlock()
+	if !irc.EqualFold(irc.nick, irc.nickcurrent) {
+		irc.nickcurrent = irc.nick
+		irc.SendRawf("NICK %s", irc.nick)
+	}
+}
+
 func (irc *Connection) isQuitting() bool {
 	irc.Lock()
 	defer irc.Unlock()
@@ -234,18 +283,56 @@ func (irc *Connection) isQuitting() bool {
 
 // Main loop to control the connection.
 func (irc *Connection) Loop() {
+	irc.LoopContext(context.Background())
+}
+
+// Main loop to control the connection until the context is done.
+// Canceling the context sends QUIT, waits up to Timeout for the server
+// to close the connection and then disconnects.
+func (irc *Connection) LoopContext(ctx context.Context) {
 	errChan := irc.ErrorChan()
 	for !irc.isQuitting() {
-		err := <-errChan
+		var err error
+		select {
+		case err = <-errChan:
+		case <-ctx.Done():
+			irc.quitContext(errChan)
+			irc.disconnected(ctx.Err())
+			return
+		}
 		if irc.end != nil {
 			close(irc.end)
 		}
 		irc.Wait()
-		for !irc.isQuitting() {
+		irc.disconnected(err)
+		policy := irc.reconnectPolicy()
+		for attempt := 0; !irc.isQuitting(); attempt++ {
+			if ctx.Err() != nil {
+				return
+			}
 			irc.Log.Printf("Error, disconnected: %s\n", err)
-			if err = irc.Reconnect(); err != nil {
+			delay, ok := policy.NextDelay(attempt, err)
+			if !ok {
+				irc.Log.Printf("Giving up reconnecting after %d attempts\n", attempt)
+				irc.Lock()
+				irc.stopped = true
+				irc.quit = true
+				irc.Unlock()
+				return
+			}
+			irc.dispatch("RECONNECTING", strconv.Itoa(attempt+1), delay.String(), err.Error())
+			if delay > 0 {
+				select {
+				case <-time.After(delay):
+				case <-ctx.Done():
+					return
+				}
+			}
+			if err = irc.ReconnectContext(ctx); err != nil {
 				irc.Log.Printf("Error while reconnecting: %s\n", err)
-				time.Sleep(60 * time.Second)
+				if ctx.Err() != nil {
+					return
+				}
 			} else {
 				errChan = irc.ErrorChan()
 				break
@@ -254,6 +341,42 @@ func (irc *Connection) Loop() {
 	}
 }
 
+// Note that the connection is gone and tell the callbacks why.
+func (irc *Connection) disconnected(err error) {
+	irc.Lock()
+	irc.registered = false
+	irc.Unlock()
+	irc.clearJoined()
+	irc.stopRejoin()
+	irc.dispatch("DISCONNECTED", err.Error())
+}
+
+// Quit because the context of LoopContext is done.
+func (irc *Connection) quitContext(errChan chan error) {
+	irc.Quit()
+	select {
+	case <-errChan:
+	case <-time.After(irc.Timeout):
+	}
+	irc.shutdown()
+}
+
+// Stop all goroutines of the current connection and close the socket
+// without waiting for buffered messages to be sent.
+func (irc *Connection) shutdown() {
+	irc.Lock()
+	irc.stopped = true
+	irc.Unlock()
+	if irc.end != nil {
+		close(irc.end)
+	}
+	if irc.socket != nil {
+		irc.socket.Close()
+	}
+	irc.Wait()
+	irc.end = nil
+}
+
 // Quit the current connection and disconnect from the server
 // RFC 1459 details: https://tools.ietf.org/html/rfc1459#section-4.1.6
 func (irc *Connection) Quit() {
@@ -273,19 +396,21 @@ func (irc *Connection) Quit() {
 // Use the connection to join a given channel.
 // RFC 1459 details: https://tools.ietf.org/html/rfc1459#section-4.2.1
 func (irc *Connection) Join(channel string) {
-	irc.pwrite <- fmt.Sprintf("JOIN %s\r\n", channel)
+	irc.rememberKeys(channel)
+	irc.enqueue(fmt.Sprintf("JOIN %s\r\n", channel))
 }
 
 // Leave a given channel.
 // RFC 1459 details: https://tools.ietf.org/html/rfc1459#section-4.2.2
 func (irc *Connection) Part(channel string) {
-	irc.pwrite <- fmt.Sprintf("PART %s\r\n", channel)
+	irc.enqueue(fmt.Sprintf("PART %s\r\n", channel))
 }
 
 // Send a notification to a nickname. This is similar to Privmsg but must not receive replies.
 // RFC 1459 details: https://tools.ietf.org/html/rfc1459#section-4.4.2
+// Long messages are split into multiple lines, as are messages containing newlines.
 func (irc *Connection) Notice(target, message string) {
-	irc.pwrite <- fmt.Sprintf("NOTICE %s :%s\r\n", target, message)
+	irc.sendSplit("NOTICE", target, "", message)
 }
 
 // Send a formated notification to a nickname.
@@ -297,7 +422,7 @@ func (irc *Connection) Noticef(target, format string, a ...interface{}) {
 // Send (action) message to a target (channel or nickname).
 // No clear RFC on this one...
 func (irc *Connection) Action(target, message string) {
-	irc.pwrite <- fmt.Sprintf("PRIVMSG %s :\001ACTION %s\001\r\n", target, message)
+	irc.sendSplit("PRIVMSG", target, "ACTION", message)
 }
 
 // Send formatted (action) message to a target (channel or nickname).
@@ -307,8 +432,9 @@ func (irc *Connection) Actionf(target, format string, a ...interface{}) {
 
 // Send (private) message to a target (channel or nickname).
 // RFC 1459 details: https://tools.ietf.org/html/rfc1459#section-4.4.1
+// Long messages are split into multiple lines, as are messages containing newlines.
 func (irc *Connection) Privmsg(target, message string) {
-	irc.pwrite <- fmt.Sprintf("PRIVMSG %s :%s\r\n", target, message)
+	irc.sendSplit("PRIVMSG", target, "", message)
 }
 
 // Send formated string to specified target (channel or nickname).
@@ -324,7 +450,7 @@ func (irc *Connection) Kick(user, channel, msg string) {
 		cmd.WriteString(fmt.Sprintf(" :%s", msg))
 	}
 	cmd.WriteString("\r\n")
-	irc.pwrite <- cmd.String()
+	irc.enqueue(cmd.String())
 }
 
 // Kick all <users> from <channel> with <msg>. For no message, pass
@@ -336,12 +462,24 @@ func (irc *Connection) MultiKick(users []string, channel string, msg string) {
 		cmd.WriteString(fmt.Sprintf(" :%s", msg))
 	}
 	cmd.WriteString("\r\n")
-	irc.pwrite <- cmd.String()
+	irc.enqueue(cmd.String())
 }
 
 // Send raw string.
 func (irc *Connection) SendRaw(message string) {
-	irc.pwrite <- message + "\r\n"
+	irc.enqueue(message + "\r\n")
+}
+
+// Send raw string, giving up if the context is done before the line
+// could be queued.
+func (irc *Connection) SendContext(ctx context.Context, message string) error {
+	line := message + "\r\n"
+	select {
+	case irc.pwrite[linePriority(line)] <- line:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
 }
 
 // Send raw formated string.
@@ -376,6 +514,7 @@ func (irc *Connection) Who(nick string) {
 // Set different modes for a target (channel or nickname).
 // RFC 1459 details: https://tools.ietf.org/html/rfc1459#section-4.2.3
 func (irc *Connection) Mode(target string, modestring ...string) {
+	irc.rememberUserModes(target, modestring)
 	if len(modestring) > 0 {
 		mode := strings.Join(modestring, " ")
 		irc.SendRawf("MODE %s %s", target, mode)
@@ -393,6 +532,14 @@ func (irc *Connection) Connected() bool {
 	return !irc.stopped
 }
 
+// Returns true once the server accepted our registration (RPL_WELCOME),
+// until the connection is lost.
+func (irc *Connection) Registered() bool {
+	irc.Lock()
+	defer irc.Unlock()
+	return irc.registered
+}
+
 // A disconnect sends all buffered messages (if possible),
 // stops all goroutines and then closes the socket.
 func (irc *Connection) Disconnect() {
@@ -407,9 +554,7 @@ func (irc *Connection) Disconnect() {
 
 	irc.end = nil
 
-	if irc.pwrite != nil {
-		close(irc.pwrite)
-	}
+	irc.closeQueues()
 
 	if irc.socket != nil {
 		irc.socket.Close()
@@ -419,29 +564,158 @@ func (irc *Connection) Disconnect() {
 
 // Reconnect to a server using the current connection.
 func (irc *Connection) Reconnect() error {
+	return irc.ReconnectContext(context.Background())
+}
+
+// Reconnect to a server using the current connection, giving up when the
+// context is done.
+func (irc *Connection) ReconnectContext(ctx context.Context) error {
 	irc.end = make(chan struct{})
-	return irc.Connect(irc.Server)
+	if redirect := irc.takeRedirect(); redirect != nil {
+		irc.Log.Printf("Following redirect to %s\n", redirect.Server)
+		if err := irc.connect(ctx, *redirect); err == nil {
+			irc.redirected = true
+			return nil
+		} else if ctx.Err() != nil {
+			return err
+		}
+		irc.resetAfterFailure()
+	} else if irc.redirected {
+		// Stay with the server we were redirected to while it is up
+		if err := irc.connect(ctx, irc.Endpoint()); err == nil || ctx.Err() != nil {
+			return err
+		}
+		irc.resetAfterFailure()
+	}
+	if irc.failover {
+		return irc.connectServers(ctx)
+	}
+	return irc.ConnectContext(ctx, irc.Server)
 }
 
 // Connect to a given server using the current connection configuration.
 // This function also takes care of identification if a password is provided.
 // RFC 1459 details: https://tools.ietf.org/html/rfc1459#section-4.1
 func (irc *Connection) Connect(server string) error {
-	irc.Server = server
+	return irc.ConnectContext(context.Background(), server)
+}
+
+// Connect to a given server like Connect. Dialing, the TLS handshake and
+// capability negotiation including SASL are aborted when the context is done.
+// If server is empty and Servers is set, the servers are tried in turn.
+// server may also be an irc:// or ircs:// URL, see ParseURL, or a ws:// or
+// wss:// URL to connect over WebSocket.
+func (irc *Connection) ConnectContext(ctx context.Context, server string) error {
+	if isIRCURL(server) {
+		u, err := ParseURL(server)
+		if err != nil {
+			return err
+		}
+		irc.applyURL(u)
+		server = u.Server
+	}
+	irc.redirected = false
+	if server == "" && len(irc.Servers) > 0 {
+		irc.failover = true
+		return irc.connectServers(ctx)
+	}
+	irc.failover = false
+	return irc.connect(ctx, Endpoint{Server: server, UseTLS: irc.UseTLS, Password: irc.Password})
+}
+
+// Connect to a single endpoint.
+func (irc *Connection) connect(ctx context.Context, ep Endpoint) error {
+	irc.Server = ep.Server
 	// mark Server as stopped since there can be an error during connect
 	irc.stopped = true
 
 	// make sure everything is ready for connection
-	if len(irc.Server) == 0 {
+	if err := checkServer(irc.Server); err != nil {
+		return err
+	}
+	if err := irc.checkConfig(); err != nil {
+		return err
+	}
+
+	if isWebSocketURL(ep.Server) {
+		ep.UseTLS = strings.HasPrefix(strings.ToLower(ep.Server), "wss://")
+	}
+	ep, err := irc.stsEndpoint(ep)
+	if err != nil {
+		return err
+	}
+	err = irc.dialAndStart(ctx, ep)
+	if upgrade, ok := err.(*stsUpgrade); ok {
+		irc.Log.Printf("STS policy requires TLS, reconnecting to %s\n", upgrade.Endpoint.Server)
+		irc.resetAfterFailure()
+		err = irc.dialAndStart(ctx, upgrade.Endpoint)
+	}
+	return err
+}
+
+// Dial the endpoint and register on the new connection.
+func (irc *Connection) dialAndStart(ctx context.Context, ep Endpoint) error {
+	socket, err := irc.dial(ctx, ep.Server)
+	if err != nil {
+		return err
+	}
+	if ep.UseTLS && !isWebSocketURL(ep.Server) {
+		conn := tls.Client(socket, irc.tlsConfig(serverHost(ep.Server)))
+		if err = irc.handshake(ctx, conn); err != nil {
+			return err
+		}
+		socket = conn
+	}
+	return irc.start(ctx, socket, ep)
+}
+
+// Register on an already established connection to the server, e.g. one
+// end of a net.Pipe. UseTLS is ignored, pass a *tls.Conn for TLS.
+// Reconnecting dials Server as usual.
+func (irc *Connection) ConnectConn(conn net.Conn) error {
+	irc.stopped = true
+	if err := irc.checkConfig(); err != nil {
+		return err
+	}
+	irc.failover, irc.redirected = false, false
+	_, isTLS := conn.(*tls.Conn)
+	err := irc.start(context.Background(), conn, Endpoint{Server: irc.Server, UseTLS: isTLS, Password: irc.Password})
+	if _, ok := err.(*stsUpgrade); ok {
+		irc.shutdown()
+		return ErrSTSUpgrade
+	}
+	return err
+}
+
+// Check a server address, either host:port, unix:///path or a ws:// or
+// wss:// URL.
+func checkServer(server string) error {
+	if len(server) == 0 {
 		return errors.New("empty 'server'")
 	}
-	if strings.Index(irc.Server, ":") == 0 {
+	if path, ok := unixPath(server); ok {
+		if path == "" {
+			return errors.New("socket path missing")
+		}
+		return nil
+	}
+	if isWebSocketURL(server) {
+		u, err := url.Parse(server)
+		if err != nil {
+			return err
+		}
+		if u.Hostname() == "" {
+			return errors.New("hostname is missing")
+		}
+		return nil
+	}
+	if strings.Index(server, ":") == 0 {
 		return errors.New("hostname is missing")
 	}
-	if strings.Index(irc.Server, ":") == len(irc.Server)-1 {
+	if strings.Index(server, ":") == len(server)-1 {
 		return errors.New("port missing")
 	}
-	_, ports, err := net.SplitHostPort(irc.Server)
+	_, ports, err := net.SplitHostPort(server)
 	if err != nil {
 		return errors.New("wrong address string")
 	}
@@ -452,6 +726,11 @@ func (irc *Connection) Connect(server string) error {
 	if !((port >= 0) && (port <= 65535)) {
 		return errors.New("port number outside valid range")
 	}
+	return nil
+}
+
+// Check the configuration needed for any connection.
+func (irc *Connection) checkConfig() error {
 	if irc.Log == nil {
 		return errors.New("'Log' points to nil")
 	}
@@ -461,24 +740,43 @@ func (irc *Connection) Connect(server string) error {
 	if len(irc.user) == 0 {
 		return errors.New("empty 'user'")
 	}
-
-	dialer := proxy.FromEnvironmentUsing(&net.Dialer{Timeout: irc.Timeout})
-	irc.socket, err = dialer.Dial("tcp", irc.Server)
-	if err != nil {
-		return err
-	}
-	if irc.UseTLS {
-		irc.socket = tls.Client(irc.socket, irc.TLSConfig)
+	irc.stsPolicies = irc.STSStore
+	if irc.stsPolicies == nil && irc.UseSTS {
+		store, err := DefaultSTSStore()
+		if err != nil {
+			return fmt.Errorf("no STSStore: %s", err)
+		}
+		irc.stsPolicies = store
 	}
+	return nil
+}
+
+// Start the loops and register on a connection to the server.
+func (irc *Connection) start(ctx context.Context, socket net.Conn, ep Endpoint) error {
+	irc.socket = socket
 
 	if irc.Encoding == nil {
 		irc.Encoding = encoding.Nop
 	}
 
+	if irc.end == nil {
+		irc.end = make(chan struct{})
+	}
+
+	irc.setEndpoint(ep)
+	irc.Lock()
 	irc.stopped = false
+	irc.registered = false
+	irc.account = ""
+	irc.identify = false
+	irc.Unlock()
+	irc.state.reset()
+	irc.resetISupport()
+	irc.resetCaps()
+	irc.setPrefix("")
 	irc.Log.Printf("Connected to %s (%s)\n", irc.Server, irc.socket.RemoteAddr())
 
-	irc.pwrite = make(chan string, 10)
+	irc.makeQueues()
 	irc.Error = make(chan error, 10)
 	irc.Add(3)
 	go irc.readLoop()
@@ -486,15 +784,18 @@ func (irc *Connection) Connect(server string) error {
 	go irc.pingLoop()
 
 	if len(irc.WebIRC) > 0 {
-		irc.pwrite <- fmt.Sprintf("WEBIRC %s\r\n", irc.WebIRC)
+		irc.enqueue(fmt.Sprintf("WEBIRC %s\r\n", irc.WebIRC))
 	}
 
-	if len(irc.Password) > 0 {
-		irc.pwrite <- fmt.Sprintf("PASS %s\r\n", irc.Password)
+	if len(ep.Password) > 0 {
+		irc.enqueue(fmt.Sprintf("PASS %s\r\n", ep.Password))
 	}
 
-	err = irc.negotiateCaps()
+	err := irc.negotiateCaps(ctx, ep)
 	if err != nil {
+		if ctx.Err() != nil {
+			irc.shutdown()
+		}
 		return err
 	}
 
@@ -503,15 +804,38 @@ func (irc *Connection) Connect(server string) error {
 		realname = irc.RealName
 	}
 
-	irc.pwrite <- fmt.Sprintf("NICK %s\r\n", irc.nick)
-	irc.pwrite <- fmt.Sprintf("USER %s 0.0.0.0 0.0.0.0 :%s\r\n", irc.user, realname)
+	irc.SendRawPriority(PriorityHigh, fmt.Sprintf("NICK %s", irc.nick))
+	irc.enqueue(fmt.Sprintf("USER %s 0.0.0.0 0.0.0.0 :%s\r\n", irc.user, realname))
+	irc.dispatch("CONNECTED", ep.Server)
+	return nil
+}
+
+// Run the TLS handshake, closing the connection if the context is done first.
+func (irc *Connection) handshake(ctx context.Context, conn *tls.Conn) error {
+	conn.SetDeadline(time.Now().Add(irc.Timeout))
+	errc := make(chan error, 1)
+	go func() { errc <- conn.Handshake() }()
+	select {
+	case err := <-errc:
+		if err != nil {
+			conn.Close()
+			return err
+		}
+	case <-ctx.Done():
+		conn.Close()
+		<-errc
+		return ctx.Err()
+	}
+	var zero time.Time
+	conn.SetDeadline(zero)
 	return nil
 }
 
 // Negotiate IRCv3 capabilities
-func (irc *Connection) negotiateCaps() error {
-	irc.RequestCaps = nil
+func (irc *Connection) negotiateCaps(ctx context.Context, ep Endpoint) error {
+	irc.capsMutex.Lock()
 	irc.AcknowledgedCaps = nil
+	irc.capsMutex.Unlock()
 
 	var negotiationCallbacks []CallbackID
 	defer func() {
@@ -520,83 +844,110 @@ func (irc *Connection) negotiateCaps() error {
 		}
 	}()
 
-	saslResChan := make(chan *SASLResult)
+	var extra []string
+	saslResChan := make(chan *SASLResult, 1)
 	if irc.UseSASL {
-		irc.RequestCaps = append(irc.RequestCaps, "sasl")
-		negotiationCallbacks = irc.setupSASLCallbacks(saslResChan)
+		extra = append(extra, "sasl")
+		negotiationCallbacks = irc.setupSASLCallbacks(saslResChan, nil)
 	}
 
-	if len(irc.RequestCaps) == 0 {
+	if len(irc.wantedCaps(extra...)) == 0 && !irc.UseSTS {
+		irc.negotiateInBackground()
 		return nil
 	}
+	wanted := irc.wantedCaps(append(extra, defaultCaps...)...)
 
-	cap_chan := make(chan bool, len(irc.RequestCaps))
-	id := irc.AddCallback("CAP", func(e *Event) {
-		if len(e.Arguments) != 3 {
-			return
-		}
-		command := e.Arguments[1]
+	ls_chan := make(chan map[string]string, 1)
+	cap_chan := make(chan bool, len(wanted))
+	irc.capsMutex.Lock()
+	irc.capLS, irc.capReplies = ls_chan, cap_chan
+	irc.capsMutex.Unlock()
+	defer func() {
+		irc.capsMutex.Lock()
+		irc.capLS, irc.capReplies = nil, nil
+		irc.capsMutex.Unlock()
+	}()
 
-		if command == "LS" {
-			missing_caps := len(irc.RequestCaps)
-			for _, cap_name := range strings.Split(e.Arguments[2], " ") {
-				for _, req_cap := range irc.RequestCaps {
-					if cap_name == req_cap {
-						irc.pwrite <- fmt.Sprintf("CAP REQ :%s\r\n", cap_name)
-						missing_caps--
-					}
-				}
-			}
+	irc.enqueue("CAP LS 302\r\n")
 
-			for i := 0; i < missing_caps; i++ {
-				cap_chan <- true
-			}
-		} else if command == "ACK" || command == "NAK" {
-			for _, cap_name := range strings.Split(strings.TrimSpace(e.Arguments[2]), " ") {
-				if cap_name == "" {
-					continue
-				}
+	var caps map[string]string
+	select {
+	case caps = <-ls_chan:
+	case <-time.After(CAP_TIMEOUT):
+		if irc.UseSASL {
+			// Raise an error if we can't authenticate with SASL.
+			return irc.saslFailed(errors.New("SASL setup timed out. Does the server support SASL?"))
+		}
+		// The server probably doesn't implement CAP LS, which is "normal".
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
 
-				if command == "ACK" {
-					irc.AcknowledgedCaps = append(irc.AcknowledgedCaps, cap_name)
-				}
-				cap_chan <- true
-			}
+	if value, ok := caps["sts"]; ok && irc.UseSTS {
+		if err := irc.handleSTS(ep, value); err != nil {
+			return err
+		}
+	}
+	sasl := irc.UseSASL
+	if _, ok := caps["sasl"]; sasl && !ok {
+		if err := irc.saslFailed(errors.New("no SASL capability")); err != nil {
+			return err
 		}
-	})
-	negotiationCallbacks = append(negotiationCallbacks, CallbackID{"CAP", id})
+		sasl = false
+	}
 
-	irc.pwrite <- "CAP LS\r\n"
+	// sasl goes in a REQ of its own, so that a refused capability
+	// requested along with it does not take SASL down too
+	var available []string
+	remaining_caps := 0
+	for _, req_cap := range wanted {
+		if _, ok := caps[req_cap]; !ok {
+			continue
+		}
+		remaining_caps++
+		if req_cap == "sasl" && sasl {
+			irc.enqueue("CAP REQ :sasl\r\n")
+		} else {
+			available = append(available, req_cap)
+		}
+	}
+	for _, line := range capRequests(available) {
+		irc.enqueue(line + "\r\n")
+	}
 
-	if irc.UseSASL {
+	if sasl {
+		var err error
 		select {
 		case res := <-saslResChan:
 			if res.Failed {
-				return res.Err
+				err = res.Err
 			}
 		case <-time.After(CAP_TIMEOUT):
 			// Raise an error if we can't authenticate with SASL.
-			return errors.New("SASL setup timed out. Does the server support SASL?")
+			irc.SendRaw("AUTHENTICATE *")
+			err = errors.New("SASL setup timed out. Does the server support SASL?")
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		if err != nil {
+			if err = irc.saslFailed(err); err != nil {
+				return err
+			}
 		}
-	}
-
-	remaining_caps := len(irc.RequestCaps)
-
-	select {
-	case <-cap_chan:
-		remaining_caps--
-	case <-time.After(CAP_TIMEOUT):
-		// The server probably doesn't implement CAP LS, which is "normal".
-		return nil
 	}
 
 	// Wait for all capabilities to be ACKed or NAKed before ending negotiation
 	for remaining_caps > 0 {
-		<-cap_chan
-		remaining_caps--
+		select {
+		case <-cap_chan:
+			remaining_caps--
+		case <-ctx.Done():
+			return ctx.Err()
+		}
 	}
 
-	irc.pwrite <- fmt.Sprintf("CAP END\r\n")
+	irc.enqueue("CAP END\r\n")
 
 	return nil
 }
@@ -614,17 +965,18 @@ func IRC(nick, user string) *Connection {
 	}
 
 	irc := &Connection{
-		nick:        nick,
-		nickcurrent: nick,
-		user:        user,
-		Log:         log.New(os.Stdout, "", log.LstdFlags),
-		end:         make(chan struct{}),
-		Version:     VERSION,
-		KeepAlive:   4 * time.Minute,
-		Timeout:     1 * time.Minute,
-		PingFreq:    15 * time.Minute,
-		SASLMech:    "PLAIN",
-		QuitMessage: "",
+		nick:            nick,
+		nickcurrent:     nick,
+		user:            user,
+		Log:             log.New(os.Stdout, "", log.LstdFlags),
+		end:             make(chan struct{}),
+		Version:         VERSION,
+		KeepAlive:       4 * time.Minute,
+		Timeout:         1 * time.Minute,
+		PingFreq:        15 * time.Minute,
+		ReconnectPolicy: &ConstantBackoff{Delay: 60 * time.Second},
+		SASLMech:        "PLAIN",
+		QuitMessage:     "",
 	}
 	irc.setupCallbacks()
 	return irc
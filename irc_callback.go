@@ -158,7 +158,9 @@ func (irc *Connection) RunCallbacks(event *Event) {
 
 	event.Ctx = context.Background()
 	if irc.CallbackTimeout != 0 {
-		event.Ctx, _ = context.WithTimeout(event.Ctx, irc.CallbackTimeout)
+		var cancel context.CancelFunc
+		event.Ctx, cancel = context.WithTimeout(event.Ctx, irc.CallbackTimeout)
+		defer cancel()
 	}
 
 	done := make(chan int)
@@ -196,6 +198,12 @@ func (irc *Connection) RunCallbacks(event *Event) {
 	}
 }
 
+// Run the callbacks for an event generated by the library itself rather
+// than received from the server.
+func (irc *Connection) dispatch(code string, args ...string) {
+	irc.RunCallbacks(&Event{Code: code, Arguments: args, Connection: irc, Time: time.Now()})
+}
+
 func getFunctionName(f func(*Event)) string {
 	return runtime.FuncForPC(reflect.ValueOf(f).Pointer()).Name()
 }
@@ -228,38 +236,12 @@ func (irc *Connection) setupCallbacks() {
 	irc.AddCallback("CTCP_PING", func(e *Event) { irc.SendRawf("NOTICE %s :\x01%s\x01", e.Nick, e.Message()) })
 
 	// 437: ERR_UNAVAILRESOURCE "<nick/channel> :Nick/channel is temporarily unavailable"
+	// 433: ERR_NICKNAMEINUSE "<nick> :Nickname is already in use"
 	// Add a _ to current nick. If irc.nickcurrent is empty this cannot
 	// work. It has to be set somewhere first in case the nick is already
 	// taken or unavailable from the beginning.
-	irc.AddCallback("437", func(e *Event) {
-		// If irc.nickcurrent hasn't been set yet, set to irc.nick
-		if irc.nickcurrent == "" {
-			irc.nickcurrent = irc.nick
-		}
-
-		if len(irc.nickcurrent) > 8 {
-			irc.nickcurrent = "_" + irc.nickcurrent
-		} else {
-			irc.nickcurrent = irc.nickcurrent + "_"
-		}
-		irc.SendRawf("NICK %s", irc.nickcurrent)
-	})
-
-	// 433: ERR_NICKNAMEINUSE "<nick> :Nickname is already in use"
-	// Add a _ to current nick.
-	irc.AddCallback("433", func(e *Event) {
-		// If irc.nickcurrent hasn't been set yet, set to irc.nick
-		if irc.nickcurrent == "" {
-			irc.nickcurrent = irc.nick
-		}
-
-		if len(irc.nickcurrent) > 8 {
-			irc.nickcurrent = "_" + irc.nickcurrent
-		} else {
-			irc.nickcurrent = irc.nickcurrent + "_"
-		}
-		irc.SendRawf("NICK %s", irc.nickcurrent)
-	})
+	irc.AddCallback("437", irc.nickFallback)
+	irc.AddCallback("433", irc.nickFallback)
 
 	irc.AddCallback("PONG", func(e *Event) {
 		ns, _ := strconv.ParseInt(e.Message(), 10, 64)
@@ -272,7 +254,7 @@ func (irc *Connection) setupCallbacks() {
 	// NICK Define a nickname.
 	// Set irc.nickcurrent to the new nick actually used in this connection.
 	irc.AddCallback("NICK", func(e *Event) {
-		if e.Nick == irc.nick {
+		if irc.EqualFold(e.Nick, irc.nick) {
 			irc.nickcurrent = e.Message()
 		}
 	})
@@ -282,6 +264,33 @@ func (irc *Connection) setupCallbacks() {
 	irc.AddCallback("001", func(e *Event) {
 		irc.Lock()
 		irc.nickcurrent = e.Arguments[0]
+		irc.registered = true
 		irc.Unlock()
+		irc.dispatch("REGISTERED", e.Arguments[0])
 	})
+
+	irc.setupISupportCallbacks()
+	irc.setupCapCallbacks()
+	irc.setupPrefixCallbacks()
+	irc.setupServerCallbacks()
+	irc.setupStateCallbacks()
+	irc.setupRejoinCallbacks()
+	irc.setupAccountCallbacks()
+}
+
+// Pick another nick after ours was rejected. Append a _ or, if that would
+// exceed the NICKLEN advertised by the server, prepend one and truncate.
+func (irc *Connection) nickFallback(e *Event) {
+	// If irc.nickcurrent hasn't been set yet, set to irc.nick
+	if irc.nickcurrent == "" {
+		irc.nickcurrent = irc.nick
+	}
+
+	nicklen := irc.ISupport().NickLen
+	if nicklen > 0 && len(irc.nickcurrent) >= nicklen {
+		irc.nickcurrent = "_" + irc.nickcurrent[:nicklen-1]
+	} else {
+		irc.nickcurrent = irc.nickcurrent + "_"
+	}
+	irc.SendRawf("NICK %s", irc.nickcurrent)
 }
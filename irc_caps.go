@@ -0,0 +1,335 @@
+package irc
+
+import (
+	"sort"
+	"strings"
+	"time"
+)
+
+// IRCv3 capability negotiation, see
+// https://ircv3.net/specs/extensions/capability-negotiation
+
+// Maximum length of the capabilities in one CAP REQ, keeping the line
+// within 512 bytes.
+const capReqLen = 510 - len("CAP REQ :")
+
+// Capabilities the library always requests. When nothing else needs to be
+// negotiated before registering, they are requested in the background,
+// see negotiateInBackground, so servers without CAP are not held up.
+var defaultCaps = []string{"server-time"}
+
+// Request defaultCaps without waiting for the server: NICK and USER follow
+// CAP LS right away and the CAP handler ends the negotiation once the
+// server answered. A server without CAP registers us as usual, one which
+// never answers our requests gets CAP END after CAP_TIMEOUT.
+func (irc *Connection) negotiateInBackground() {
+	done, end := make(chan struct{}), irc.end
+	irc.capsMutex.Lock()
+	irc.capPending, irc.capDone = 0, done
+	irc.capsMutex.Unlock()
+	irc.enqueue("CAP LS 302\r\n")
+
+	irc.Add(1)
+	go func() {
+		defer irc.Done()
+		select {
+		case <-time.After(CAP_TIMEOUT):
+		case <-done:
+			return
+		case <-end:
+			return
+		}
+		irc.capsMutex.Lock()
+		timedOut := irc.capDone == done
+		if timedOut {
+			irc.endBackground()
+		}
+		irc.capsMutex.Unlock()
+		if timedOut {
+			select {
+			case irc.pwrite[PriorityHigh] <- "CAP END\r\n":
+			case <-end:
+			}
+		}
+	}()
+}
+
+// Stop the background negotiation. Must hold capsMutex.
+func (irc *Connection) endBackground() {
+	if irc.capDone != nil {
+		close(irc.capDone)
+	}
+	irc.capDone = nil
+}
+
+// Go on with a background negotiation after CAP LS, or after the server
+// answered n requested capabilities. Returns the lines to send once
+// capsMutex is released. Must hold capsMutex.
+func (irc *Connection) continueInBackground(ls bool, n int) (lines []string) {
+	if irc.capDone == nil {
+		return nil
+	}
+	if ls {
+		var request []string
+		for _, name := range defaultCaps {
+			if _, ok := irc.caps[name]; ok {
+				request = append(request, name)
+			}
+		}
+		lines = capRequests(request)
+		irc.capPending = len(request)
+	} else {
+		irc.capPending -= n
+	}
+	if irc.capPending <= 0 {
+		irc.endBackground()
+		lines = append(lines, "CAP END")
+	}
+	return lines
+}
+
+// Split the capabilities of CAP LS 302 into names and values.
+func parseCaps(caps []string) map[string]string {
+	values := make(map[string]string, len(caps))
+	for _, c := range caps {
+		kv := strings.SplitN(c, "=", 2)
+		if len(kv) == 2 {
+			values[kv[0]] = kv[1]
+		} else {
+			values[kv[0]] = ""
+		}
+	}
+	return values
+}
+
+// Returns the CAP REQ lines requesting caps, as few as possible.
+func capRequests(caps []string) (lines []string) {
+	var list string
+	for _, c := range caps {
+		if list != "" && len(list)+1+len(c) > capReqLen {
+			lines = append(lines, "CAP REQ :"+list)
+			list = ""
+		}
+		if list != "" {
+			list += " "
+		}
+		list += c
+	}
+	if list != "" {
+		lines = append(lines, "CAP REQ :"+list)
+	}
+	return lines
+}
+
+// Tells the code that requested a capability what became of it: enabled
+// is true when the server acknowledges it, false when the server refuses
+// it or withdraws it with CAP DEL. value is the value offered by the
+// server, if any.
+type CapHandler func(name, value string, enabled bool)
+
+// Request a capability on every connection, in addition to RequestCaps.
+// handler may be nil. Capabilities the server offers later with CAP NEW are
+// requested then.
+func (irc *Connection) RequestCap(name string, handler CapHandler) {
+	irc.capsMutex.Lock()
+	defer irc.capsMutex.Unlock()
+	if irc.capHandlers == nil {
+		irc.capHandlers = make(map[string][]CapHandler)
+	}
+	if _, ok := irc.capHandlers[name]; !ok {
+		irc.capNames = append(irc.capNames, name)
+	}
+	if handler != nil {
+		irc.capHandlers[name] = append(irc.capHandlers[name], handler)
+	} else if irc.capHandlers[name] == nil {
+		irc.capHandlers[name] = []CapHandler{}
+	}
+}
+
+// Returns true if the server acknowledged a capability on this connection.
+func (irc *Connection) HasCap(name string) bool {
+	irc.capsMutex.Lock()
+	defer irc.capsMutex.Unlock()
+	for _, c := range irc.AcknowledgedCaps {
+		if c == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the capabilities to request: those of RequestCap, then
+// RequestCaps, then extra, without duplicates.
+func (irc *Connection) wantedCaps(extra ...string) []string {
+	irc.capsMutex.Lock()
+	names := append(append(append([]string(nil), irc.capNames...), irc.RequestCaps...), extra...)
+	irc.capsMutex.Unlock()
+	seen := make(map[string]bool, len(names))
+	wanted := names[:0]
+	for _, name := range names {
+		if !seen[name] {
+			seen[name] = true
+			wanted = append(wanted, name)
+		}
+	}
+	return wanted
+}
+
+// Call the handlers registered for a capability.
+func (irc *Connection) runCapHandlers(name string, enabled bool) {
+	irc.capsMutex.Lock()
+	handlers, value := irc.capHandlers[name], irc.caps[name]
+	irc.capsMutex.Unlock()
+	for _, handler := range handlers {
+		handler(name, value, enabled)
+	}
+}
+
+// Returns the capabilities offered by the server, with their values, e.g.
+// "sasl" => "PLAIN,EXTERNAL". Kept up to date by CAP NEW and CAP DEL.
+func (irc *Connection) ServerCaps() map[string]string {
+	irc.capsMutex.Lock()
+	defer irc.capsMutex.Unlock()
+	caps := make(map[string]string, len(irc.caps))
+	for name, value := range irc.caps {
+		caps[name] = value
+	}
+	return caps
+}
+
+func (irc *Connection) resetCaps() {
+	irc.capsMutex.Lock()
+	irc.caps = make(map[string]string)
+	irc.capLSLines = nil
+	irc.endBackground()
+	irc.capsMutex.Unlock()
+}
+
+// Remove a capability from AcknowledgedCaps. Must hold capsMutex.
+func (irc *Connection) dropCap(name string) {
+	acked := irc.AcknowledgedCaps[:0]
+	for _, c := range irc.AcknowledgedCaps {
+		if c != name {
+			acked = append(acked, c)
+		}
+	}
+	irc.AcknowledgedCaps = acked
+}
+
+// Set up the CAP handler. It tracks the capabilities offered and
+// acknowledged and passes the replies to negotiateCaps while connecting.
+// CAP NEW and CAP DEL are dispatched as CAP_NEW and CAP_DEL with the names
+// of the capabilities.
+func (irc *Connection) setupCapCallbacks() {
+	irc.caps = make(map[string]string)
+
+	// Registered, a server without CAP will not answer anymore
+	irc.AddCallback("001", func(e *Event) {
+		irc.capsMutex.Lock()
+		irc.endBackground()
+		irc.capsMutex.Unlock()
+	})
+
+	irc.AddCallback("CAP", func(e *Event) {
+		if len(e.Arguments) < 3 {
+			return
+		}
+		tokens := strings.Fields(e.Arguments[len(e.Arguments)-1])
+		caps := parseCaps(tokens)
+		names := make([]string, 0, len(caps))
+		for name := range caps {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		switch e.Arguments[1] {
+		case "LS":
+			irc.capsMutex.Lock()
+			irc.capLSLines = append(irc.capLSLines, tokens...)
+			// CAP * LS * :caps is followed by more lines
+			if len(e.Arguments) == 4 && e.Arguments[2] == "*" {
+				irc.capsMutex.Unlock()
+				return
+			}
+			irc.caps = parseCaps(irc.capLSLines)
+			irc.capLSLines = nil
+			lines := irc.continueInBackground(true, 0)
+			ls := irc.capLS
+			irc.capsMutex.Unlock()
+			for _, line := range lines {
+				irc.SendRaw(line)
+			}
+			if ls != nil {
+				select {
+				case ls <- irc.ServerCaps():
+				default:
+				}
+			}
+
+		case "ACK", "NAK":
+			irc.capsMutex.Lock()
+			for _, name := range tokens {
+				if e.Arguments[1] == "NAK" {
+					continue
+				}
+				if strings.HasPrefix(name, "-") {
+					irc.dropCap(name[1:])
+				} else {
+					irc.dropCap(name)
+					irc.AcknowledgedCaps = append(irc.AcknowledgedCaps, name)
+				}
+			}
+			replies := irc.capReplies
+			lines := irc.continueInBackground(false, len(tokens))
+			irc.capsMutex.Unlock()
+			for _, line := range lines {
+				irc.SendRaw(line)
+			}
+			for _, name := range tokens {
+				enabled := e.Arguments[1] == "ACK" && !strings.HasPrefix(name, "-")
+				irc.runCapHandlers(strings.TrimPrefix(name, "-"), enabled)
+			}
+			for range tokens {
+				select {
+				case replies <- true:
+				default:
+				}
+			}
+
+		case "NEW":
+			irc.capsMutex.Lock()
+			for name, value := range caps {
+				irc.caps[name] = value
+			}
+			irc.capsMutex.Unlock()
+			var request []string
+			for _, name := range irc.wantedCaps(defaultCaps...) {
+				if _, ok := caps[name]; ok && !irc.HasCap(name) {
+					request = append(request, name)
+				}
+			}
+			for _, line := range capRequests(request) {
+				irc.SendRaw(line)
+			}
+			irc.dispatch("CAP_NEW", names...)
+
+		case "DEL":
+			var dropped []string
+			irc.capsMutex.Lock()
+			for _, name := range names {
+				for _, c := range irc.AcknowledgedCaps {
+					if c == name {
+						dropped = append(dropped, name)
+					}
+				}
+				delete(irc.caps, name)
+				irc.dropCap(name)
+			}
+			irc.capsMutex.Unlock()
+			for _, name := range dropped {
+				irc.runCapHandlers(name, false)
+			}
+			irc.dispatch("CAP_DEL", names...)
+		}
+	})
+}
@@ -0,0 +1,320 @@
+package irc
+
+import (
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCapRequests(t *testing.T) {
+	if lines := capRequests(nil); len(lines) != 0 {
+		t.Errorf("capRequests(nil) = %q", lines)
+	}
+	lines := capRequests([]string{"sasl", "multi-prefix", "server-time"})
+	if !reflect.DeepEqual(lines, []string{"CAP REQ :sasl multi-prefix server-time"}) {
+		t.Errorf("capRequests() = %q", lines)
+	}
+	var caps []string
+	for i := 0; i < 100; i++ {
+		caps = append(caps, "draft/capability")
+	}
+	lines = capRequests(caps)
+	if len(lines) != 4 {
+		t.Errorf("%d lines", len(lines))
+	}
+	for _, line := range lines {
+		if len(line) > 510 {
+			t.Errorf("Line of %d bytes", len(line))
+		}
+	}
+}
+
+func TestCapNegotiation(t *testing.T) {
+	lines := make(chan string, 100)
+	l := scriptServer(t, lines, func(line string) []string {
+		switch {
+		case line == "CAP LS 302":
+			return []string{":server CAP * LS * :multi-prefix sasl=PLAIN,EXTERNAL", ":server CAP * LS :away-notify"}
+		case strings.HasPrefix(line, "CAP REQ :"):
+			return []string{":server CAP go-eventirc ACK :" + strings.TrimPrefix(line, "CAP REQ :")}
+		case line == "AUTHENTICATE PLAIN":
+			return []string{"AUTHENTICATE +"}
+		case strings.HasPrefix(line, "AUTHENTICATE "):
+			return []string{":server 903 go-eventirc :SASL authentication successful"}
+		case strings.HasPrefix(line, "USER "):
+			return []string{
+				":server 001 go-eventirc :Welcome",
+				":server CAP go-eventirc NEW :extended-join chghost=1",
+				":server CAP go-eventirc DEL :sasl",
+			}
+		}
+		return nil
+	})
+	defer l.Close()
+
+	irccon := IRC("go-eventirc", "go-eventirc")
+	debugTest(irccon)
+	irccon.UseSASL = true
+	events := make(chan []string, 2)
+	irccon.AddCallback("CAP_NEW", func(e *Event) { events <- e.Arguments })
+	irccon.AddCallback("CAP_DEL", func(e *Event) { events <- e.Arguments })
+	if err := irccon.Connect(l.Addr().String()); err != nil {
+		t.Fatal(err)
+	}
+	defer irccon.shutdown()
+	expectLine(t, lines, "CAP REQ :sasl")
+	expectLine(t, lines, "CAP END")
+
+	for _, expected := range [][]string{{"chghost", "extended-join"}, {"sasl"}} {
+		select {
+		case names := <-events:
+			if !reflect.DeepEqual(names, expected) {
+				t.Errorf("Event %q, expected %q", names, expected)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("No event for %q", expected)
+		}
+	}
+	caps := irccon.ServerCaps()
+	expected := map[string]string{"multi-prefix": "", "away-notify": "", "extended-join": "", "chghost": "1"}
+	if !reflect.DeepEqual(caps, expected) {
+		t.Errorf("ServerCaps() = %v", caps)
+	}
+	irccon.capsMutex.Lock()
+	acked := irccon.AcknowledgedCaps
+	irccon.capsMutex.Unlock()
+	if len(acked) != 0 {
+		t.Errorf("AcknowledgedCaps = %q after CAP DEL", acked)
+	}
+}
+
+func TestRequestCap(t *testing.T) {
+	lines := make(chan string, 100)
+	l := scriptServer(t, lines, func(line string) []string {
+		switch {
+		case line == "CAP LS 302":
+			return []string{":server CAP * LS :multi-prefix away-notify=1 chghost"}
+		case line == "CAP REQ :echo-message":
+			return []string{":server CAP go-eventirc NAK :echo-message"}
+		case strings.HasPrefix(line, "CAP REQ :"):
+			return []string{":server CAP go-eventirc ACK :" + strings.TrimPrefix(line, "CAP REQ :")}
+		case strings.HasPrefix(line, "USER "):
+			return []string{":server 001 go-eventirc :Welcome", ":server CAP go-eventirc NEW :echo-message"}
+		case line == "PING :del":
+			return []string{":server CAP go-eventirc DEL :away-notify"}
+		}
+		return nil
+	})
+	defer l.Close()
+
+	type capResult struct {
+		name, value string
+		enabled     bool
+	}
+	results := make(chan capResult, 10)
+	handler := func(name, value string, enabled bool) {
+		results <- capResult{name, value, enabled}
+	}
+	irccon := IRC("go-eventirc", "go-eventirc")
+	debugTest(irccon)
+	irccon.RequestCaps = []string{"multi-prefix", "sasl"}
+	irccon.RequestCap("away-notify", handler)
+	irccon.RequestCap("echo-message", handler)
+	irccon.RequestCap("multi-prefix", nil)
+	if err := irccon.Connect(l.Addr().String()); err != nil {
+		t.Fatal(err)
+	}
+	defer irccon.shutdown()
+	expectLine(t, lines, "CAP REQ :away-notify multi-prefix")
+	expectLine(t, lines, "CAP END")
+	if !irccon.HasCap("away-notify") || !irccon.HasCap("multi-prefix") || irccon.HasCap("chghost") {
+		t.Error("Wrong capabilities acknowledged")
+	}
+
+	expected := []capResult{{"away-notify", "1", true}, {"echo-message", "", false}, {"away-notify", "", false}}
+	for i, e := range expected {
+		if i == 2 {
+			irccon.SendRaw("PING :del")
+		}
+		select {
+		case r := <-results:
+			if r != e {
+				t.Errorf("Handler called with %+v, expected %+v", r, e)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("No handler call for %+v", e)
+		}
+	}
+	expectLine(t, lines, "CAP REQ :echo-message")
+	if irccon.HasCap("away-notify") {
+		t.Error("away-notify enabled after CAP DEL")
+	}
+}
+
+func TestServerTime(t *testing.T) {
+	lines := make(chan string, 100)
+	l := scriptServer(t, lines, func(line string) []string {
+		switch {
+		case line == "CAP LS 302":
+			return []string{":server CAP * LS :multi-prefix server-time"}
+		case strings.HasPrefix(line, "CAP REQ :"):
+			return []string{":server CAP go-eventirc ACK :" + strings.TrimPrefix(line, "CAP REQ :")}
+		case strings.HasPrefix(line, "USER "):
+			return []string{
+				"@time=2011-10-19T16:40:51.620Z :nick!user@host PRIVMSG go-eventirc :played back",
+				":nick!user@host PRIVMSG go-eventirc :live",
+			}
+		}
+		return nil
+	})
+	defer l.Close()
+
+	irccon := IRC("go-eventirc", "go-eventirc")
+	debugTest(irccon)
+	irccon.RequestCaps = []string{"multi-prefix"}
+	times := make(chan time.Time, 2)
+	irccon.AddCallback("PRIVMSG", func(e *Event) { times <- e.Time })
+	start := time.Now()
+	if err := irccon.Connect(l.Addr().String()); err != nil {
+		t.Fatal(err)
+	}
+	defer irccon.shutdown()
+	expectLine(t, lines, "CAP REQ :multi-prefix server-time")
+
+	if played := <-times; !played.Equal(time.Date(2011, 10, 19, 16, 40, 51, 620000000, time.UTC)) {
+		t.Errorf("Time of played back message %v", played)
+	}
+	if live := <-times; live.Before(start) || live.After(time.Now()) {
+		t.Errorf("Time of live message %v", live)
+	}
+}
+
+func TestSASLOwnRequest(t *testing.T) {
+	for _, refuseSASL := range []bool{false, true} {
+		lines := make(chan string, 100)
+		l := scriptServer(t, lines, func(line string) []string {
+			switch {
+			case line == "CAP LS 302":
+				return []string{":server CAP * LS :sasl=PLAIN multi-prefix draft/refused"}
+			case line == "CAP REQ :sasl" && refuseSASL,
+				strings.HasPrefix(line, "CAP REQ :") && strings.Contains(line, "draft/refused"):
+				return []string{":server CAP go-eventirc NAK :" + strings.TrimPrefix(line, "CAP REQ :")}
+			case strings.HasPrefix(line, "CAP REQ :"):
+				return []string{":server CAP go-eventirc ACK :" + strings.TrimPrefix(line, "CAP REQ :")}
+			case line == "AUTHENTICATE PLAIN":
+				return []string{"AUTHENTICATE +"}
+			case strings.HasPrefix(line, "AUTHENTICATE "):
+				return []string{":server 903 go-eventirc :SASL authentication successful"}
+			}
+			return nil
+		})
+
+		irccon := IRC("go-eventirc", "go-eventirc")
+		debugTest(irccon)
+		irccon.UseSASL = true
+		irccon.RequestCaps = []string{"multi-prefix", "draft/refused"}
+		start := time.Now()
+		err := irccon.Connect(l.Addr().String())
+		if refuseSASL {
+			if err == nil || time.Since(start) > 5*time.Second {
+				t.Errorf("Refused sasl: %v after %s", err, time.Since(start))
+			}
+		} else {
+			if err != nil {
+				t.Errorf("SASL failed along with another capability: %v", err)
+			}
+			expectLine(t, lines, "CAP END")
+			if !irccon.HasCap("sasl") || irccon.HasCap("multi-prefix") {
+				t.Error("Wrong capabilities acknowledged")
+			}
+		}
+		irccon.shutdown()
+		l.Close()
+	}
+}
+
+func TestServerTimeBackground(t *testing.T) {
+	for _, later := range []bool{false, true} {
+		lines := make(chan string, 100)
+		playback := "@time=2011-10-19T16:40:51.620Z :nick!user@host PRIVMSG go-eventirc :played back"
+		l := scriptServer(t, lines, func(line string) []string {
+			switch {
+			case line == "CAP LS 302" && later:
+				return []string{":server CAP * LS :multi-prefix"}
+			case line == "CAP LS 302":
+				return []string{":server CAP * LS :multi-prefix server-time"}
+			case strings.HasPrefix(line, "CAP REQ :") && later:
+				return []string{":server CAP go-eventirc ACK :" + strings.TrimPrefix(line, "CAP REQ :"), playback}
+			case strings.HasPrefix(line, "CAP REQ :"):
+				return []string{":server CAP go-eventirc ACK :" + strings.TrimPrefix(line, "CAP REQ :")}
+			case line == "CAP END" && later:
+				return []string{":server 001 go-eventirc :Welcome", ":server CAP go-eventirc NEW :server-time"}
+			case line == "CAP END":
+				return []string{":server 001 go-eventirc :Welcome", playback}
+			}
+			return nil
+		})
+
+		irccon := IRC("go-eventirc", "go-eventirc")
+		debugTest(irccon)
+		times := make(chan time.Time, 1)
+		irccon.AddCallback("PRIVMSG", func(e *Event) { times <- e.Time })
+		if err := irccon.Connect(l.Addr().String()); err != nil {
+			t.Fatal(err)
+		}
+		expectLine(t, lines, "CAP LS 302")
+		expectLine(t, lines, "USER ")
+		if !later {
+			expectLine(t, lines, "CAP REQ :server-time")
+		}
+		expectLine(t, lines, "CAP END")
+		if later {
+			expectLine(t, lines, "CAP REQ :server-time")
+		}
+		select {
+		case played := <-times:
+			if !played.Equal(time.Date(2011, 10, 19, 16, 40, 51, 620000000, time.UTC)) {
+				t.Errorf("Time of played back message %v", played)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("No message received")
+		}
+		if !irccon.HasCap("server-time") {
+			t.Error("server-time not acknowledged")
+		}
+		irccon.shutdown()
+		l.Close()
+	}
+}
+
+func TestServerTimeBackgroundTimeout(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping test in short mode.")
+	}
+	// Offers server-time, but never answers the request
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	lines := make(chan string, 100)
+	capServer(l, "server-time", lines)
+
+	irccon := IRC("go-eventirc", "go-eventirc")
+	debugTest(irccon)
+	if err := irccon.Connect(l.Addr().String()); err != nil {
+		t.Fatal(err)
+	}
+	defer irccon.shutdown()
+	expectLine(t, lines, "CAP REQ :server-time")
+	select {
+	case line := <-lines:
+		if line != "CAP END" {
+			t.Errorf("Server got %q", line)
+		}
+	case <-time.After(CAP_TIMEOUT + 5*time.Second):
+		t.Fatal("Negotiation not ended")
+	}
+}
@@ -0,0 +1,73 @@
+package irc
+
+import (
+	"strings"
+
+	"golang.org/x/text/secure/precis"
+)
+
+// Case mappings as advertised by the CASEMAPPING ISUPPORT token.
+const (
+	CaseMappingASCII         = "ascii"
+	CaseMappingRFC1459       = "rfc1459"
+	CaseMappingRFC1459Strict = "rfc1459-strict"
+	CaseMappingRFC7613       = "rfc7613"
+)
+
+// Fold s to lower case using the given case mapping. Unknown mappings
+// are treated as rfc1459, the default of RFC 1459 servers.
+// With rfc1459 the characters []\^ are the upper case versions of {}|~,
+// rfc1459-strict does the same without ^ and ~, and rfc7613 applies the
+// PRECIS UsernameCaseMapped profile to allow for non-ASCII nicks.
+func CaseFold(casemapping, s string) string {
+	switch casemapping {
+	case CaseMappingASCII:
+		return foldASCII(s, 'Z')
+	case CaseMappingRFC1459Strict:
+		return foldASCII(s, ']')
+	case CaseMappingRFC7613:
+		if folded, err := precis.UsernameCaseMapped.String(s); err == nil {
+			return folded
+		}
+		return strings.ToLower(s)
+	default:
+		return foldASCII(s, '^')
+	}
+}
+
+// Returns true if a and b are equal under the given case mapping.
+func EqualFold(casemapping, a, b string) bool {
+	return CaseFold(casemapping, a) == CaseFold(casemapping, b)
+}
+
+// Fold A-Z and, if last is past 'Z', the characters following it up to last.
+func foldASCII(s string, last byte) string {
+	i := 0
+	for i < len(s) && !(s[i] >= 'A' && s[i] <= last) {
+		i++
+	}
+	if i == len(s) {
+		return s
+	}
+	b := []byte(s)
+	for ; i < len(b); i++ {
+		if b[i] >= 'A' && b[i] <= last {
+			b[i] += 'a' - 'A'
+		}
+	}
+	return string(b)
+}
+
+// Fold a nick or channel name using the case mapping of the server.
+func (irc *Connection) CaseFold(s string) string {
+	irc.isupportMutex.Lock()
+	casemapping := irc.isupport.CaseMapping
+	irc.isupportMutex.Unlock()
+	return CaseFold(casemapping, s)
+}
+
+// Returns true if two nicks or channel names are equal using the case
+// mapping of the server.
+func (irc *Connection) EqualFold(a, b string) bool {
+	return irc.CaseFold(a) == irc.CaseFold(b)
+}
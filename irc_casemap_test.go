@@ -0,0 +1,67 @@
+package irc
+
+import (
+	"testing"
+)
+
+func TestCaseFold(t *testing.T) {
+	tests := []struct {
+		casemapping, in, out string
+	}{
+		{CaseMappingASCII, "Foo[]\\^", "foo[]\\^"},
+		{CaseMappingRFC1459, "Foo[]\\^", "foo{}|~"},
+		{CaseMappingRFC1459Strict, "Foo[]\\^", "foo{}|^"},
+		{CaseMappingRFC7613, "FooÉ", "fooé"},
+		{"unknown", "Foo[", "foo{"},
+		{CaseMappingRFC1459, "already", "already"},
+	}
+	for _, test := range tests {
+		if out := CaseFold(test.casemapping, test.in); out != test.out {
+			t.Errorf("CaseFold(%q, %q) = %q, want %q", test.casemapping, test.in, out, test.out)
+		}
+	}
+	if !EqualFold(CaseMappingRFC1459, "[Foo]", "{foo}") {
+		t.Error("EqualFold failed with rfc1459")
+	}
+	if EqualFold(CaseMappingASCII, "[Foo]", "{foo}") {
+		t.Error("EqualFold folded brackets with ascii")
+	}
+}
+
+func TestCaseFoldServerMapping(t *testing.T) {
+	irccon := IRC("go-eventirc", "go-eventirc")
+	irccon.TrackState = true
+	if !irccon.EqualFold("Nick[a]", "nick{A}") {
+		t.Error("Default rfc1459 mapping not used")
+	}
+	feed(t, irccon,
+		":server 005 go-eventirc CASEMAPPING=ascii :are supported by this server",
+		":Go-EventIRC!~go@host JOIN #Test",
+		":Other!~o@h JOIN #test",
+		":OTHER!~o@h NICK Other2",
+	)
+	if irccon.EqualFold("a[", "a{") {
+		t.Error("ascii mapping from ISUPPORT not used")
+	}
+	if !irccon.State().IsOn("#TEST", "other2") {
+		t.Error("State lookups are not case insensitive")
+	}
+	if m, _ := irccon.State().Member("#test", "OTHER2"); m.Nick != "Other2" {
+		t.Errorf("Nick = %q", m.Nick)
+	}
+}
+
+func TestRecoverNick(t *testing.T) {
+	irccon := IRC("Nick[a]", "go-eventirc")
+	irccon.makeQueues()
+	feed(t, irccon, ":server 001 nick{A} :Welcome")
+	irccon.recoverNick()
+	if n := len(irccon.pwrite[PriorityNormal]) + len(irccon.pwrite[PriorityHigh]); n != 0 {
+		t.Fatalf("%d lines queued for a nick differing only in case", n)
+	}
+	feed(t, irccon, ":nick{A}!~go@host NICK other")
+	irccon.recoverNick()
+	if line, _ := irccon.nextLine(); line != "NICK Nick[a]\r\n" {
+		t.Errorf("nextLine() = %q", line)
+	}
+}
@@ -0,0 +1,147 @@
+package irc
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Listen on a local port and hand every accepted connection to handle.
+func localServer(t *testing.T, handle func(net.Conn)) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go handle(conn)
+		}
+	}()
+	return l
+}
+
+func TestConnectContextCancel(t *testing.T) {
+	// A server which never answers CAP LS
+	l := localServer(t, func(conn net.Conn) {
+		bufio.NewReader(conn).ReadString(0)
+		conn.Close()
+	})
+	defer l.Close()
+
+	irccon := IRC("go-eventirc", "go-eventirc")
+	debugTest(irccon)
+	irccon.UseSASL = true
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	err := irccon.ConnectContext(ctx, l.Addr().String())
+	if err != context.DeadlineExceeded {
+		t.Fatalf("ConnectContext() = %v", err)
+	}
+	if time.Since(start) > 5*time.Second {
+		t.Fatal("ConnectContext did not return when the context expired")
+	}
+	if irccon.Connected() {
+		t.Fatal("Still connected after canceled ConnectContext")
+	}
+}
+
+func TestLoopContextCancel(t *testing.T) {
+	quit := make(chan string, 1)
+	l := localServer(t, func(conn net.Conn) {
+		defer conn.Close()
+		r := bufio.NewReader(conn)
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			if strings.HasPrefix(line, "QUIT") {
+				quit <- line
+				return
+			}
+		}
+	})
+	defer l.Close()
+
+	irccon := IRC("go-eventirc", "go-eventirc")
+	debugTest(irccon)
+	irccon.QuitMessage = "bye"
+	if err := irccon.Connect(l.Addr().String()); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		irccon.LoopContext(ctx)
+		close(done)
+	}()
+	cancel()
+
+	select {
+	case line := <-quit:
+		if line != "QUIT :bye\r\n" {
+			t.Errorf("Server got %q", line)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("No QUIT sent after cancel")
+	}
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("LoopContext did not return after cancel")
+	}
+}
+
+func TestSendContext(t *testing.T) {
+	irccon := IRC("go-eventirc", "go-eventirc")
+	irccon.makeQueues()
+	for i := 0; i < queueSize; i++ {
+		irccon.SendRaw("JOIN #channel")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := irccon.SendContext(ctx, "JOIN #full"); err != context.DeadlineExceeded {
+		t.Fatalf("SendContext() on full queue = %v", err)
+	}
+	if err := irccon.SendContext(context.Background(), "PONG :server"); err != nil {
+		t.Fatalf("SendContext() = %v", err)
+	}
+}
+
+func TestLoopContextCancelWhileReconnecting(t *testing.T) {
+	l := localServer(t, func(conn net.Conn) {
+		bufio.NewReader(conn).ReadString('\n')
+		conn.Close()
+	})
+
+	irccon := IRC("go-eventirc", "go-eventirc")
+	debugTest(irccon)
+	irccon.ReconnectPolicy = &ExponentialBackoff{Min: time.Millisecond}
+	ctx, cancel := context.WithCancel(context.Background())
+	irccon.AddCallback("RECONNECTING", func(e *Event) { cancel() })
+	if err := irccon.Connect(l.Addr().String()); err != nil {
+		t.Fatal(err)
+	}
+	l.Close()
+
+	done := make(chan struct{})
+	go func() {
+		irccon.LoopContext(ctx)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("LoopContext kept reconnecting after cancel")
+	}
+}
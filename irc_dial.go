@@ -0,0 +1,230 @@
+package irc
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"golang.org/x/net/proxy"
+)
+
+// A Dialer opens the network connection to the server, set it as
+// Connection.Dialer. TLS is added on top by the Connection if UseTLS is set.
+type Dialer interface {
+	DialContext(ctx context.Context, network, addr string) (net.Conn, error)
+}
+
+// Which IP versions a DirectDialer uses.
+type AddressFamily int
+
+const (
+	AnyFamily  AddressFamily = iota //Use addresses in the order the resolver returns them
+	PreferIPv4                      //Try IPv4 addresses first
+	PreferIPv6                      //Try IPv6 addresses first
+	OnlyIPv4
+	OnlyIPv6
+)
+
+// Connects to the server without a proxy.
+type DirectDialer struct {
+	LocalAddr string        //Local IP address to connect from, empty for any
+	Family    AddressFamily //IP versions to use
+	Timeout   time.Duration //Timeout of each connection attempt, 0 for none
+}
+
+func (d *DirectDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: d.Timeout}
+	if d.LocalAddr != "" {
+		ip := net.ParseIP(d.LocalAddr)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid local address %q", d.LocalAddr)
+		}
+		dialer.LocalAddr = &net.TCPAddr{IP: ip}
+	}
+
+	switch d.Family {
+	case OnlyIPv4:
+		return dialer.DialContext(ctx, network+"4", addr)
+	case OnlyIPv6:
+		return dialer.DialContext(ctx, network+"6", addr)
+	case PreferIPv4, PreferIPv6:
+	default:
+		return dialer.DialContext(ctx, network, addr)
+	}
+
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	if net.ParseIP(host) != nil {
+		return dialer.DialContext(ctx, network, addr)
+	}
+	ips, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	wantIPv4 := d.Family == PreferIPv4
+	sort.SliceStable(ips, func(i, j int) bool {
+		return (ips[i].IP.To4() != nil) == wantIPv4 && (ips[j].IP.To4() != nil) != wantIPv4
+	})
+	for _, ip := range ips {
+		var conn net.Conn
+		conn, err = dialer.DialContext(ctx, network, net.JoinHostPort(ip.String(), port))
+		if err == nil || ctx.Err() != nil {
+			return conn, err
+		}
+	}
+	return nil, err
+}
+
+// Connects through a SOCKS5 proxy. Host names are resolved by the proxy.
+type SOCKS5Dialer struct {
+	Addr     string //host:port of the proxy
+	Username string //Optional
+	Password string
+	Forward  Dialer //Used to reach the proxy, nil for a direct connection
+}
+
+func (d *SOCKS5Dialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	var auth *proxy.Auth
+	if d.Username != "" {
+		auth = &proxy.Auth{User: d.Username, Password: d.Password}
+	}
+	dialer, err := proxy.SOCKS5("tcp", d.Addr, auth, proxyDialer{forward(d.Forward)})
+	if err != nil {
+		return nil, err
+	}
+	return dialer.(proxy.ContextDialer).DialContext(ctx, network, addr)
+}
+
+// Connects through an HTTP proxy using the CONNECT method.
+type HTTPProxyDialer struct {
+	Addr     string //host:port of the proxy
+	Username string //Optional, sent with basic authentication
+	Password string
+	Forward  Dialer //Used to reach the proxy, nil for a direct connection
+}
+
+func (d *HTTPProxyDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	conn, err := forward(d.Forward).DialContext(ctx, "tcp", d.Addr)
+	if err != nil {
+		return nil, err
+	}
+
+	// Close the connection if the context is done during the handshake
+	stop := closeOnDone(ctx, conn)
+	defer stop()
+
+	req := fmt.Sprintf("CONNECT %s HTTP/1.1\r\nHost: %s\r\n", addr, addr)
+	if d.Username != "" {
+		creds := base64.StdEncoding.EncodeToString([]byte(d.Username + ":" + d.Password))
+		req += "Proxy-Authorization: Basic " + creds + "\r\n"
+	}
+	br := bufio.NewReader(conn)
+	if _, err = conn.Write([]byte(req + "\r\n")); err == nil {
+		var resp *http.Response
+		resp, err = http.ReadResponse(br, &http.Request{Method: "CONNECT"})
+		if err == nil && resp.StatusCode != http.StatusOK {
+			err = errors.New("proxy refused connection: " + resp.Status)
+		}
+	}
+	if err != nil {
+		conn.Close()
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, err
+	}
+	// The server may already have sent something through the tunnel
+	if br.Buffered() > 0 {
+		return &bufferedConn{conn, br}, nil
+	}
+	return conn, nil
+}
+
+// A net.Conn reading data already buffered before reading from the
+// connection.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+// Close conn when the context is done, until stop is called. stop returns
+// once the watching goroutine has exited, so conn is not closed afterwards.
+func closeOnDone(ctx context.Context, conn net.Conn) (stop func()) {
+	done, exited := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(exited)
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-done:
+		}
+	}()
+	return func() {
+		close(done)
+		<-exited
+	}
+}
+
+// Returns d, or a direct dialer if d is nil.
+func forward(d Dialer) Dialer {
+	if d == nil {
+		return &net.Dialer{}
+	}
+	return d
+}
+
+// Returns the socket path of a unix:///path server address.
+func unixPath(server string) (string, bool) {
+	if !strings.HasPrefix(server, "unix://") {
+		return "", false
+	}
+	return strings.TrimPrefix(server, "unix://"), true
+}
+
+// Adapts a Dialer to the proxy package.
+type proxyDialer struct {
+	Dialer
+}
+
+func (d proxyDialer) Dial(network, addr string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, addr)
+}
+
+// Open a connection to addr with the Dialer, or directly or through the
+// proxy given in the environment if it is nil. unix:// addresses are
+// always dialed directly, ws:// and wss:// URLs open a WebSocket.
+func (irc *Connection) dial(ctx context.Context, addr string) (net.Conn, error) {
+	if isWebSocketURL(addr) {
+		return irc.dialWebSocket(ctx, addr)
+	}
+	if path, ok := unixPath(addr); ok {
+		dialer := &net.Dialer{Timeout: irc.Timeout}
+		return dialer.DialContext(ctx, "unix", path)
+	}
+	if irc.Dialer != nil {
+		if irc.Timeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, irc.Timeout)
+			defer cancel()
+		}
+		return irc.Dialer.DialContext(ctx, "tcp", addr)
+	}
+	dialer := proxy.FromEnvironmentUsing(&net.Dialer{Timeout: irc.Timeout})
+	if d, ok := dialer.(proxy.ContextDialer); ok {
+		return d.DialContext(ctx, "tcp", addr)
+	}
+	return dialer.Dial("tcp", addr)
+}
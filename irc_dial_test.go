@@ -0,0 +1,272 @@
+package irc
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Read one line from conn with a timeout.
+func readLine(t *testing.T, conn net.Conn) string {
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	return line
+}
+
+func TestDirectDialer(t *testing.T) {
+	l := localServer(t, func(conn net.Conn) {
+		conn.Write([]byte("hello\r\n"))
+		conn.Close()
+	})
+	defer l.Close()
+	_, port, _ := net.SplitHostPort(l.Addr().String())
+
+	for _, d := range []*DirectDialer{
+		{},
+		{LocalAddr: "127.0.0.1"},
+		{Family: OnlyIPv4},
+		{Family: PreferIPv4},
+		{Family: PreferIPv6},
+	} {
+		conn, err := d.DialContext(context.Background(), "tcp", net.JoinHostPort("localhost", port))
+		if err != nil {
+			t.Errorf("%+v: %s", d, err)
+			continue
+		}
+		if line := readLine(t, conn); line != "hello\r\n" {
+			t.Errorf("%+v: got %q", d, line)
+		}
+		conn.Close()
+	}
+
+	d := &DirectDialer{Family: OnlyIPv6}
+	if conn, err := d.DialContext(context.Background(), "tcp", l.Addr().String()); err == nil {
+		conn.Close()
+		t.Error("Connected to an IPv4 address with OnlyIPv6")
+	}
+}
+
+func TestHTTPProxyDialer(t *testing.T) {
+	requests := make(chan string, 1)
+	l := localServer(t, func(conn net.Conn) {
+		defer conn.Close()
+		r := bufio.NewReader(conn)
+		var req []string
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			if line == "\r\n" {
+				break
+			}
+			req = append(req, strings.TrimSpace(line))
+		}
+		requests <- strings.Join(req, "|")
+		// The IRC server speaks right after the tunnel is up
+		conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n:server NOTICE * :hello\r\n"))
+	})
+	defer l.Close()
+
+	d := &HTTPProxyDialer{Addr: l.Addr().String(), Username: "user", Password: "pass"}
+	conn, err := d.DialContext(context.Background(), "tcp", "irc.example.org:6667")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	req := <-requests
+	if req != "CONNECT irc.example.org:6667 HTTP/1.1|Host: irc.example.org:6667|Proxy-Authorization: Basic dXNlcjpwYXNz" {
+		t.Errorf("Proxy got %q", req)
+	}
+	if line := readLine(t, conn); line != ":server NOTICE * :hello\r\n" {
+		t.Errorf("Got %q through the tunnel", line)
+	}
+}
+
+func TestHTTPProxyDialerRefused(t *testing.T) {
+	l := localServer(t, func(conn net.Conn) {
+		bufio.NewReader(conn).ReadString('\n')
+		conn.Write([]byte("HTTP/1.1 403 Forbidden\r\n\r\n"))
+		conn.Close()
+	})
+	defer l.Close()
+
+	d := &HTTPProxyDialer{Addr: l.Addr().String()}
+	if _, err := d.DialContext(context.Background(), "tcp", "irc.example.org:6667"); err == nil {
+		t.Fatal("DialContext succeeded")
+	}
+}
+
+func TestSOCKS5Dialer(t *testing.T) {
+	targets := make(chan string, 1)
+	l := localServer(t, func(conn net.Conn) {
+		defer conn.Close()
+		// Greeting: version, methods
+		buf := make([]byte, 2)
+		io.ReadFull(conn, buf)
+		io.ReadFull(conn, make([]byte, buf[1]))
+		conn.Write([]byte{5, 0})
+		// Request: version, command, reserved, domain name, port
+		buf = make([]byte, 5)
+		io.ReadFull(conn, buf)
+		host := make([]byte, buf[4])
+		io.ReadFull(conn, host)
+		port := make([]byte, 2)
+		io.ReadFull(conn, port)
+		targets <- net.JoinHostPort(string(host), strconv.Itoa(int(binary.BigEndian.Uint16(port))))
+		conn.Write([]byte{5, 0, 0, 1, 127, 0, 0, 1, 0, 0})
+		conn.Write([]byte("hello\r\n"))
+	})
+	defer l.Close()
+
+	d := &SOCKS5Dialer{Addr: l.Addr().String()}
+	conn, err := d.DialContext(context.Background(), "tcp", "irc.example.onion:6697")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if target := <-targets; target != "irc.example.onion:6697" {
+		t.Errorf("Proxy asked for %q", target)
+	}
+	if line := readLine(t, conn); line != "hello\r\n" {
+		t.Errorf("Got %q through the proxy", line)
+	}
+}
+
+// A Dialer counting its connections.
+type countingDialer struct {
+	DirectDialer
+	dials int
+}
+
+func (d *countingDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	d.dials++
+	return d.DirectDialer.DialContext(ctx, network, addr)
+}
+
+func TestConnectDialer(t *testing.T) {
+	lines := make(chan string, 1)
+	l := firstLineServer(t, lines)
+	defer l.Close()
+
+	irccon := IRC("go-eventirc", "go-eventirc")
+	debugTest(irccon)
+	d := &countingDialer{}
+	irccon.Dialer = d
+	if err := irccon.Connect(l.Addr().String()); err != nil {
+		t.Fatal(err)
+	}
+	defer irccon.shutdown()
+	if d.dials != 1 {
+		t.Errorf("Dialer used %d times", d.dials)
+	}
+	select {
+	case <-lines:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Nothing received")
+	}
+}
+
+func TestConnectUnix(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-ircevent")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "irc.sock")
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		t.Skip("Unix sockets not supported:", err)
+	}
+	defer l.Close()
+	lines := make(chan string, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		if line, err := bufio.NewReader(conn).ReadString('\n'); err == nil {
+			lines <- line
+		}
+	}()
+
+	irccon := IRC("go-eventirc", "go-eventirc")
+	debugTest(irccon)
+	if err := irccon.Connect("unix://" + path); err != nil {
+		t.Fatal(err)
+	}
+	defer irccon.shutdown()
+	select {
+	case line := <-lines:
+		if line != "CAP LS 302\r\n" {
+			t.Errorf("Server got %q", line)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Nothing received")
+	}
+
+	if err := irccon.Connect("unix://"); err == nil {
+		t.Error("Connected without a socket path")
+	}
+}
+
+func TestConnectConn(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+
+	irccon := IRC("go-eventirc", "go-eventirc")
+	debugTest(irccon)
+	registered := make(chan struct{})
+	irccon.AddCallback("REGISTERED", func(e *Event) { close(registered) })
+	if err := irccon.ConnectConn(client); err != nil {
+		t.Fatal(err)
+	}
+	defer irccon.shutdown()
+
+	r := bufio.NewReader(server)
+	for _, expected := range []string{"CAP LS 302\r\n", "NICK go-eventirc\r\n", "USER go-eventirc 0.0.0.0 0.0.0.0 :go-eventirc\r\n"} {
+		server.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if line, err := r.ReadString('\n'); line != expected {
+			t.Fatalf("Server got %q, %v", line, err)
+		}
+	}
+	server.Write([]byte(":server 001 go-eventirc :Welcome\r\n"))
+	select {
+	case <-registered:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Not registered")
+	}
+}
+
+func TestCloseOnDone(t *testing.T) {
+	// On one thread, the watcher only runs after stop and cancel
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(1))
+	for i := 0; i < 100; i++ {
+		client, server := net.Pipe()
+		ctx, cancel := context.WithCancel(context.Background())
+		stop := closeOnDone(ctx, client)
+		stop()
+		cancel()
+		runtime.Gosched()
+		go server.Read(make([]byte, 1))
+		if _, err := client.Write([]byte("x")); err != nil {
+			t.Fatalf("Connection closed after stop: %s", err)
+		}
+		client.Close()
+		server.Close()
+	}
+}
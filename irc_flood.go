@@ -0,0 +1,66 @@
+package irc
+
+import (
+	"time"
+)
+
+// Outgoing flood control settings. Lines are sent immediately as long as
+// we are less than Burst lines ahead of the allowed rate of one line per
+// Rate. Longer lines cost more, like the penalty of hybrid/ratbox servers.
+type FloodControl struct {
+	Burst       int           //Number of lines which may be sent at once
+	Rate        time.Duration //Time it takes to earn another line
+	BytePenalty int           //Every BytePenalty bytes of a line cost one extra line. 0 disables.
+}
+
+// Settings similar to the defaults of irssi, which keep clients well clear
+// of excess flood limits on common servers.
+var DefaultFloodControl = FloodControl{
+	Burst:       5,
+	Rate:        2 * time.Second,
+	BytePenalty: 120,
+}
+
+// Token bucket keeping track of the time at which we are allowed to send
+// again. The wait happens before a line is picked from the queues, so a
+// line of higher priority queued meanwhile is sent first.
+// Not safe for concurrent use, only the writeLoop uses it.
+type floodLimiter struct {
+	FloodControl
+	next time.Time
+}
+
+func newFloodLimiter(fc *FloodControl) *floodLimiter {
+	if fc == nil || fc.Rate <= 0 {
+		return nil
+	}
+	return &floodLimiter{FloodControl: *fc}
+}
+
+// Returns how long to wait at now before the next line may be sent.
+func (l *floodLimiter) wait(now time.Time) time.Duration {
+	if l.next.Before(now) {
+		return 0
+	}
+	burst := l.Burst
+	if burst < 1 {
+		burst = 1
+	}
+	wait := l.next.Sub(now) - time.Duration(burst-1)*l.Rate
+	if wait < 0 {
+		return 0
+	}
+	return wait
+}
+
+// Account for a line of n bytes sent at now.
+func (l *floodLimiter) charge(now time.Time, n int) {
+	if l.next.Before(now) {
+		l.next = now
+	}
+	cost := l.Rate
+	if l.BytePenalty > 0 {
+		cost += time.Duration(n/l.BytePenalty) * l.Rate
+	}
+	l.next = l.next.Add(cost)
+}
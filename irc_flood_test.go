@@ -0,0 +1,44 @@
+package irc
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFloodLimiterBurst(t *testing.T) {
+	l := newFloodLimiter(&FloodControl{Burst: 3, Rate: 2 * time.Second})
+	now := time.Now()
+	for i := 0; i < 3; i++ {
+		if wait := l.wait(now); wait != 0 {
+			t.Fatalf("Line %d of burst delayed by %s", i, wait)
+		}
+		l.charge(now, 10)
+	}
+	if wait := l.wait(now); wait != 2*time.Second {
+		t.Fatalf("Line after burst delayed by %s", wait)
+	}
+
+	// The bucket refills over time
+	now = now.Add(20 * time.Second)
+	for i := 0; i < 3; i++ {
+		if wait := l.wait(now); wait != 0 {
+			t.Fatalf("Line %d after refill delayed by %s", i, wait)
+		}
+		l.charge(now, 10)
+	}
+}
+
+func TestFloodLimiterBytePenalty(t *testing.T) {
+	l := newFloodLimiter(&FloodControl{Burst: 2, Rate: time.Second, BytePenalty: 100})
+	now := time.Now()
+	l.charge(now, 250)
+	if wait := l.wait(now); wait != 2*time.Second {
+		t.Fatalf("Line after a long line delayed by %s", wait)
+	}
+}
+
+func TestFloodLimiterDisabled(t *testing.T) {
+	if newFloodLimiter(nil) != nil || newFloodLimiter(&FloodControl{}) != nil {
+		t.Fatal("Limiter created without a rate")
+	}
+}
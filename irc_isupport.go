@@ -0,0 +1,199 @@
+package irc
+
+import (
+	"strconv"
+	"strings"
+)
+
+// Server capabilities advertised with RPL_ISUPPORT (005).
+// See https://modern.ircdocs.horse/#rplisupport-005
+// Fields hold the RFC defaults until the server tells us otherwise.
+type ISupport struct {
+	CaseMapping   string
+	NickLen       int
+	ChannelLen    int
+	TopicLen      int
+	ChanTypes     string
+	PrefixModes   string    //Membership modes, highest first. E.g. "ov"
+	PrefixSymbols string    //Matching membership prefixes. E.g. "@+"
+	ChanModes     [4]string //Channel modes of type A, B, C and D
+	Modes         int       //Max number of parameter modes per MODE, 0 if unlimited
+	TargMax       map[string]int
+	LineLen       int
+	Network       string
+	Tokens        map[string]string //All tokens with their unescaped values
+}
+
+func defaultISupport() *ISupport {
+	return &ISupport{
+		CaseMapping:   "rfc1459",
+		NickLen:       9,
+		ChannelLen:    200,
+		ChanTypes:     "#&",
+		PrefixModes:   "ov",
+		PrefixSymbols: "@+",
+		ChanModes:     [4]string{"beI", "k", "l", "imnpst"},
+		Modes:         3,
+		TargMax:       make(map[string]int),
+		LineLen:       512,
+		Tokens:        make(map[string]string),
+	}
+}
+
+func (is *ISupport) copy() *ISupport {
+	c := *is
+	c.TargMax = make(map[string]int, len(is.TargMax))
+	for k, v := range is.TargMax {
+		c.TargMax[k] = v
+	}
+	c.Tokens = make(map[string]string, len(is.Tokens))
+	for k, v := range is.Tokens {
+		c.Tokens[k] = v
+	}
+	return &c
+}
+
+// Returns the maximum number of targets for a command, or 0 if unlimited or unknown.
+func (is *ISupport) MaxTargets(command string) int {
+	return is.TargMax[strings.ToUpper(command)]
+}
+
+// Unescape \xHH sequences in ISUPPORT values.
+func unescapeISupportValue(value string) string {
+	if !strings.Contains(value, "\\x") {
+		return value
+	}
+	var b strings.Builder
+	for i := 0; i < len(value); i++ {
+		if value[i] == '\\' && i+3 < len(value) && value[i+1] == 'x' {
+			if c, err := strconv.ParseUint(value[i+2:i+4], 16, 8); err == nil {
+				b.WriteByte(byte(c))
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(value[i])
+	}
+	return b.String()
+}
+
+// Apply the tokens of a single 005 reply.
+func (is *ISupport) parse(tokens []string) {
+	def := defaultISupport()
+	for _, token := range tokens {
+		if token == "" {
+			continue
+		}
+		if token[0] == '-' {
+			name := strings.ToUpper(token[1:])
+			delete(is.Tokens, name)
+			is.set(name, "", def)
+			continue
+		}
+		parts := strings.SplitN(token, "=", 2)
+		name := strings.ToUpper(parts[0])
+		value := ""
+		if len(parts) == 2 {
+			value = unescapeISupportValue(parts[1])
+		}
+		is.Tokens[name] = value
+		is.set(name, value, def)
+	}
+}
+
+// Set the typed field for a token. An empty value restores the default
+// for tokens which require one.
+func (is *ISupport) set(name, value string, def *ISupport) {
+	atoi := func(fallback int) int {
+		if n, err := strconv.Atoi(value); err == nil && n >= 0 {
+			return n
+		}
+		return fallback
+	}
+	switch name {
+	case "CASEMAPPING":
+		is.CaseMapping = strings.ToLower(value)
+		if value == "" {
+			is.CaseMapping = def.CaseMapping
+		}
+	case "NICKLEN", "MAXNICKLEN":
+		is.NickLen = atoi(def.NickLen)
+	case "CHANNELLEN":
+		is.ChannelLen = atoi(def.ChannelLen)
+	case "TOPICLEN":
+		is.TopicLen = atoi(def.TopicLen)
+	case "CHANTYPES":
+		is.ChanTypes = value
+		if _, ok := is.Tokens[name]; !ok {
+			is.ChanTypes = def.ChanTypes
+		}
+	case "PREFIX":
+		is.PrefixModes, is.PrefixSymbols = def.PrefixModes, def.PrefixSymbols
+		if _, ok := is.Tokens[name]; ok {
+			is.PrefixModes, is.PrefixSymbols = "", ""
+			if i := strings.Index(value, ")"); strings.HasPrefix(value, "(") && i > -1 {
+				modes, symbols := value[1:i], value[i+1:]
+				if len(modes) == len(symbols) {
+					is.PrefixModes, is.PrefixSymbols = modes, symbols
+				}
+			}
+		}
+	case "CHANMODES":
+		is.ChanModes = def.ChanModes
+		if value != "" {
+			is.ChanModes = [4]string{}
+			copy(is.ChanModes[:], strings.SplitN(value, ",", 4))
+		}
+	case "MODES":
+		is.Modes = atoi(0)
+		if _, ok := is.Tokens[name]; !ok {
+			is.Modes = def.Modes
+		}
+	case "TARGMAX":
+		is.TargMax = make(map[string]int)
+		for _, target := range strings.Split(value, ",") {
+			parts := strings.SplitN(target, ":", 2)
+			if len(parts) != 2 || parts[0] == "" {
+				continue
+			}
+			n, _ := strconv.Atoi(parts[1])
+			is.TargMax[strings.ToUpper(parts[0])] = n
+		}
+	case "LINELEN":
+		is.LineLen = atoi(def.LineLen)
+		if is.LineLen < def.LineLen {
+			is.LineLen = def.LineLen
+		}
+	case "NETWORK":
+		is.Network = value
+	}
+}
+
+// Returns a copy of the server capabilities received with RPL_ISUPPORT
+// on the current connection.
+func (irc *Connection) ISupport() *ISupport {
+	irc.isupportMutex.Lock()
+	defer irc.isupportMutex.Unlock()
+	return irc.isupport.copy()
+}
+
+func (irc *Connection) resetISupport() {
+	irc.isupportMutex.Lock()
+	irc.isupport = defaultISupport()
+	irc.isupportMutex.Unlock()
+}
+
+// Set up the RPL_ISUPPORT handler.
+func (irc *Connection) setupISupportCallbacks() {
+	irc.isupport = defaultISupport()
+
+	// 5: RPL_ISUPPORT "<me> <token>[=<value>] ... :are supported by this server"
+	irc.AddCallback("005", func(e *Event) {
+		if len(e.Arguments) < 3 {
+			return
+		}
+		irc.isupportMutex.Lock()
+		irc.isupport.parse(e.Arguments[1 : len(e.Arguments)-1])
+		irc.isupportMutex.Unlock()
+	})
+}
@@ -0,0 +1,116 @@
+package irc
+
+import (
+	"testing"
+)
+
+func TestISupportDefaults(t *testing.T) {
+	irccon := IRC("go-eventirc", "go-eventirc")
+	is := irccon.ISupport()
+	if is.NickLen != 9 || is.LineLen != 512 || is.CaseMapping != "rfc1459" {
+		t.Fatalf("Unexpected defaults: %+v", is)
+	}
+}
+
+func TestISupportParse(t *testing.T) {
+	irccon := IRC("go-eventirc", "go-eventirc")
+	feed(t, irccon,
+		":server 005 go-eventirc CASEMAPPING=ascii NICKLEN=30 CHANTYPES=# PREFIX=(qaohv)~&@%+ CHANMODES=beI,k,l,imnpst MODES=4 :are supported by this server",
+		":server 005 go-eventirc TARGMAX=PRIVMSG:4,NOTICE:4,JOIN: LINELEN=2048 NETWORK=Example\\x20Net EXCEPTS :are supported by this server",
+	)
+	is := irccon.ISupport()
+	if is.CaseMapping != "ascii" {
+		t.Errorf("CaseMapping = %q", is.CaseMapping)
+	}
+	if is.NickLen != 30 {
+		t.Errorf("NickLen = %d", is.NickLen)
+	}
+	if is.ChanTypes != "#" {
+		t.Errorf("ChanTypes = %q", is.ChanTypes)
+	}
+	if is.PrefixModes != "qaohv" || is.PrefixSymbols != "~&@%+" {
+		t.Errorf("Prefix = %q %q", is.PrefixModes, is.PrefixSymbols)
+	}
+	if is.Modes != 4 {
+		t.Errorf("Modes = %d", is.Modes)
+	}
+	if is.MaxTargets("privmsg") != 4 || is.MaxTargets("JOIN") != 0 {
+		t.Errorf("TargMax = %v", is.TargMax)
+	}
+	if is.LineLen != 2048 {
+		t.Errorf("LineLen = %d", is.LineLen)
+	}
+	if is.Network != "Example Net" {
+		t.Errorf("Network = %q", is.Network)
+	}
+	if _, ok := is.Tokens["EXCEPTS"]; !ok {
+		t.Error("Value-less token not recorded")
+	}
+
+	feed(t, irccon, ":server 005 go-eventirc -NICKLEN -EXCEPTS :are supported by this server")
+	is = irccon.ISupport()
+	if is.NickLen != 9 {
+		t.Errorf("Negated NICKLEN not reset, got %d", is.NickLen)
+	}
+	if _, ok := is.Tokens["EXCEPTS"]; ok {
+		t.Error("Negated token not removed")
+	}
+}
+
+func TestISupportModeParsing(t *testing.T) {
+	irccon := IRC("go-eventirc", "go-eventirc")
+	irccon.TrackState = true
+	feed(t, irccon,
+		":server 005 go-eventirc PREFIX=(qaohv)~&@%+ CHANMODES=beI,k,l,imnpstf :are supported by this server",
+		":go-eventirc!~go@host JOIN #test",
+		":server 353 go-eventirc = #test :go-eventirc ~owner %half",
+		":server 366 go-eventirc #test :End of /NAMES list.",
+		":owner!~o@h MODE #test +hfb go-eventirc *!*@spam",
+	)
+	m, _ := irccon.State().Member("#test", "go-eventirc")
+	if m.Prefixes != "%" {
+		t.Errorf("Prefixes = %q", m.Prefixes)
+	}
+	m, _ = irccon.State().Member("#test", "owner")
+	if !m.IsOp() {
+		t.Error("Owner is not an op")
+	}
+	ch, _ := irccon.State().Channel("#test")
+	if _, ok := ch.Modes['f']; !ok || len(ch.Modes) != 1 {
+		t.Errorf("Modes = %v", ch.Modes)
+	}
+}
+
+func TestISupportOpRanks(t *testing.T) {
+	irccon := IRC("go-eventirc", "go-eventirc")
+	irccon.TrackState = true
+	feed(t, irccon,
+		":server 005 go-eventirc PREFIX=(Yov)!@+ :are supported by this server",
+		":go-eventirc!~go@host JOIN #test",
+		":server 353 go-eventirc = #test :go-eventirc !admin +voice",
+		":server 366 go-eventirc #test :End of /NAMES list.",
+		":someone!~s@h JOIN #test",
+	)
+	for nick, op := range map[string]bool{"admin": true, "voice": false, "someone": false} {
+		m, _ := irccon.State().Member("#test", nick)
+		if m.IsOp() != op {
+			t.Errorf("%s IsOp() = %v", nick, m.IsOp())
+		}
+	}
+}
+
+func TestNickFallback(t *testing.T) {
+	irccon := IRC("abcdefghi", "go-eventirc")
+	irccon.makeQueues()
+	feed(t, irccon, ":server 433 * abcdefghi :Nickname is already in use")
+	if irccon.GetNick() != "_abcdefgh" {
+		t.Errorf("GetNick() = %q", irccon.GetNick())
+	}
+	feed(t, irccon,
+		":server 005 * NICKLEN=30 :are supported by this server",
+		":server 433 * _abcdefgh :Nickname is already in use",
+	)
+	if irccon.GetNick() != "_abcdefgh_" {
+		t.Errorf("GetNick() = %q", irccon.GetNick())
+	}
+}
@@ -0,0 +1,131 @@
+package irc
+
+import (
+	"errors"
+	"sort"
+	"strings"
+)
+
+var (
+	ErrEmptyCommand   = errors.New("message has no command")
+	ErrInvalidLine    = errors.New("message contains CR, LF or NUL")
+	ErrInvalidParam   = errors.New("only the last parameter may be empty, contain spaces or start with ':'")
+	ErrInvalidTag     = errors.New("invalid tag name")
+	ErrInvalidCommand = errors.New("invalid command or source")
+)
+
+// An outgoing IRC message. Use SendMessage to send it, which takes care of
+// escaping tag values and placing the trailing parameter.
+// Details of the message format: https://modern.ircdocs.horse/#messages
+type Message struct {
+	Tags    map[string]string //IRCv3 message tags. Empty values are sent without '='.
+	Source  string            //Usually empty for messages sent by clients
+	Command string
+	Params  []string
+}
+
+// Create a message with the given command and parameters.
+func NewMessage(command string, params ...string) *Message {
+	return &Message{Command: command, Params: params}
+}
+
+// Escape tag values as defined in the IRCv3.2 message tags spec.
+// This is the inverse of unescapeTagValue.
+func escapeTagValue(value string) string {
+	return tagEscaper.Replace(value)
+}
+
+var tagEscaper = strings.NewReplacer(
+	"\\", "\\\\",
+	";", "\\:",
+	" ", "\\s",
+	"\r", "\\r",
+	"\n", "\\n",
+)
+
+// Serialize the message without the trailing CRLF. Returns an error if the
+// message can not be represented on a single line.
+func (m *Message) MarshalText() ([]byte, error) {
+	var b strings.Builder
+
+	if len(m.Tags) > 0 {
+		keys := make([]string, 0, len(m.Tags))
+		for key := range m.Tags {
+			if key == "" || strings.ContainsAny(key, "=; \r\n\x00") {
+				return nil, ErrInvalidTag
+			}
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		b.WriteByte('@')
+		for i, key := range keys {
+			if i > 0 {
+				b.WriteByte(';')
+			}
+			b.WriteString(key)
+			if value := m.Tags[key]; value != "" {
+				if strings.IndexByte(value, 0) > -1 {
+					return nil, ErrInvalidLine
+				}
+				b.WriteByte('=')
+				b.WriteString(escapeTagValue(value))
+			}
+		}
+		b.WriteByte(' ')
+	}
+
+	if m.Source != "" {
+		if strings.ContainsAny(m.Source, " \r\n\x00") {
+			return nil, ErrInvalidCommand
+		}
+		b.WriteByte(':')
+		b.WriteString(m.Source)
+		b.WriteByte(' ')
+	}
+
+	if m.Command == "" {
+		return nil, ErrEmptyCommand
+	}
+	if strings.ContainsAny(m.Command, " :\r\n\x00") {
+		return nil, ErrInvalidCommand
+	}
+	b.WriteString(m.Command)
+
+	for i, param := range m.Params {
+		if strings.ContainsAny(param, "\r\n\x00") {
+			return nil, ErrInvalidLine
+		}
+		b.WriteByte(' ')
+		if i == len(m.Params)-1 {
+			if param == "" || param[0] == ':' || strings.IndexByte(param, ' ') > -1 {
+				b.WriteByte(':')
+			}
+		} else if param == "" || param[0] == ':' || strings.IndexByte(param, ' ') > -1 {
+			return nil, ErrInvalidParam
+		}
+		b.WriteString(param)
+	}
+
+	return []byte(b.String()), nil
+}
+
+// Returns the serialized message without the trailing CRLF, or an empty
+// string if the message is invalid. See MarshalText.
+func (m *Message) String() string {
+	text, err := m.MarshalText()
+	if err != nil {
+		return ""
+	}
+	return string(text)
+}
+
+// Send a message. Returns an error without sending anything if the
+// message is invalid.
+func (irc *Connection) SendMessage(m *Message) error {
+	text, err := m.MarshalText()
+	if err != nil {
+		return err
+	}
+	irc.enqueue(string(text) + "\r\n")
+	return nil
+}
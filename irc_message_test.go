@@ -0,0 +1,78 @@
+package irc
+
+import (
+	"testing"
+)
+
+func TestMessageString(t *testing.T) {
+	tests := []struct {
+		msg  *Message
+		line string
+	}{
+		{NewMessage("PING", "123"), "PING 123"},
+		{NewMessage("PRIVMSG", "#channel", "message text"), "PRIVMSG #channel :message text"},
+		{NewMessage("PRIVMSG", "#channel", ""), "PRIVMSG #channel :"},
+		{NewMessage("PRIVMSG", "#channel", ":)"), "PRIVMSG #channel ::)"},
+		{NewMessage("QUIT"), "QUIT"},
+		{&Message{Source: "nick!user@host", Command: "JOIN", Params: []string{"#channel"}}, ":nick!user@host JOIN #channel"},
+		{&Message{
+			Tags:    map[string]string{"+draft/reply": "abc", "label": "a;b c\\d", "flag": ""},
+			Command: "TAGMSG",
+			Params:  []string{"#channel"},
+		}, "@+draft/reply=abc;flag;label=a\\:b\\sc\\\\d TAGMSG #channel"},
+	}
+	for _, test := range tests {
+		if line := test.msg.String(); line != test.line {
+			t.Errorf("String() = %q, want %q", line, test.line)
+		}
+	}
+}
+
+func TestMessageInvalid(t *testing.T) {
+	tests := []*Message{
+		NewMessage(""),
+		NewMessage("PRIVMSG", "#channel", "injected\r\nQUIT"),
+		NewMessage("PRIVMSG", "#channel\n", "text"),
+		NewMessage("PRIVMSG", "#chan nel", "text"),
+		NewMessage("PRIVMSG", "", "text"),
+		NewMessage("PRIV MSG", "text"),
+		{Tags: map[string]string{"a=b": "c"}, Command: "TAGMSG"},
+		{Source: "a b", Command: "PING"},
+	}
+	for _, msg := range tests {
+		if _, err := msg.MarshalText(); err == nil {
+			t.Errorf("MarshalText() accepted %#v", msg)
+		}
+		if msg.String() != "" {
+			t.Errorf("String() of invalid message %#v not empty", msg)
+		}
+	}
+}
+
+func TestMessageTagRoundTrip(t *testing.T) {
+	values := []string{"plain", "semi;colon", "sp ace", "back\\slash", "\\s", "cr\rlf\n", "\\\\:"}
+	for _, value := range values {
+		msg := &Message{Tags: map[string]string{"tag": value}, Command: "PING", Params: []string{"x"}}
+		event, err := parseToEvent(msg.String())
+		if err != nil {
+			t.Fatalf("Parse of %q failed", msg.String())
+		}
+		if event.Tags["tag"] != value {
+			t.Errorf("Tag value %q came back as %q", value, event.Tags["tag"])
+		}
+	}
+}
+
+func TestSendMessage(t *testing.T) {
+	irccon := IRC("go-eventirc", "go-eventirc")
+	irccon.makeQueues()
+	if err := irccon.SendMessage(NewMessage("PRIVMSG", "#channel", "a\nb")); err == nil {
+		t.Fatal("SendMessage accepted a newline")
+	}
+	if err := irccon.SendMessage(NewMessage("PRIVMSG", "#channel", "hi there")); err != nil {
+		t.Fatal(err)
+	}
+	if line := <-irccon.pwrite[PriorityLow]; line != "PRIVMSG #channel :hi there\r\n" {
+		t.Errorf("Sent %q", line)
+	}
+}
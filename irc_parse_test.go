@@ -2,6 +2,7 @@ package irc
 
 import (
 	"testing"
+	"time"
 )
 
 func checkResult(t *testing.T, event *Event) {
@@ -44,3 +45,20 @@ func TestParseTags(t *testing.T) {
 		t.Fatal("Parsing tag failed")
 	}
 }
+
+func TestParseServerTime(t *testing.T) {
+	event, err := parseToEvent("@time=2011-10-19T16:40:51.620Z :nick!~user@host PRIVMSG #channel :message text")
+	if err != nil {
+		t.Fatal("Parse PRIVMSG with server-time failed")
+	}
+	checkResult(t, event)
+	expected := time.Date(2011, 10, 19, 16, 40, 51, 620000000, time.UTC)
+	if !event.Time.Equal(expected) {
+		t.Fatalf("Time = %v", event.Time)
+	}
+
+	event, _ = parseToEvent("@time=yesterday :nick!~user@host PRIVMSG #channel :message text")
+	if !event.Time.IsZero() {
+		t.Fatalf("Time = %v for invalid tag", event.Time)
+	}
+}
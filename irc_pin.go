@@ -0,0 +1,200 @@
+package irc
+
+import (
+	"crypto"
+	"crypto/sha256"
+	_ "crypto/sha512" // For CertFingerprint
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// Pins server certificates by the SHA-256 hash of their public key, see
+// SPKIFingerprint. Pinning replaces the verification of the certificate
+// chain, so it also works for self-signed certificates and .onion hosts.
+type CertPinning struct {
+	Pins  []string //Accepted fingerprints. Takes precedence over Store.
+	Store PinStore //Trust on first use: remember the key of each host the first time
+}
+
+// A PinStore keeps the pinned key fingerprint of each host.
+type PinStore interface {
+	Get(host string) (string, bool)
+	Set(host, pin string) error
+}
+
+// Stores pins in a JSON file.
+type FilePinStore struct {
+	Path string
+	mu   sync.Mutex
+}
+
+// Returns a store in the user's configuration directory. Fails if there is
+// none, set Path then.
+func DefaultPinStore() (*FilePinStore, error) {
+	path, err := configPath("pins.json")
+	if err != nil {
+		return nil, err
+	}
+	return &FilePinStore{Path: path}, nil
+}
+
+func (s *FilePinStore) Get(host string) (string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	pins := make(map[string]string)
+	if err := loadJSON(s.Path, &pins); err != nil {
+		return "", false
+	}
+	pin, ok := pins[strings.ToLower(host)]
+	return pin, ok
+}
+
+func (s *FilePinStore) Set(host, pin string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	pins := make(map[string]string)
+	if err := loadJSON(s.Path, &pins); err != nil {
+		return err
+	}
+	pins[strings.ToLower(host)] = pin
+	return saveJSON(s.Path, pins)
+}
+
+// Returns the hex encoded SHA-256 hash of the public key of cert.
+func SPKIFingerprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return hex.EncodeToString(sum[:])
+}
+
+// Returns the hex encoded hash of the certificate, as expected by
+// NickServ CERT ADD. Pass crypto.SHA256 or crypto.SHA512 as your network
+// requires.
+func CertFingerprint(cert tls.Certificate, hash crypto.Hash) (string, error) {
+	if len(cert.Certificate) == 0 {
+		return "", errors.New("no certificate")
+	}
+	if !hash.Available() {
+		return "", errors.New("hash function not available")
+	}
+	h := hash.New()
+	h.Write(cert.Certificate[0])
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// Normalize a fingerprint written with colons or in upper case.
+func normalizePin(pin string) string {
+	return strings.ToLower(strings.Replace(pin, ":", "", -1))
+}
+
+// Check the key of the server certificate against the pins for host.
+func (p *CertPinning) verify(host string, certs []*x509.Certificate) error {
+	if len(certs) == 0 {
+		return errors.New("no server certificate")
+	}
+	fingerprint := SPKIFingerprint(certs[0])
+
+	if len(p.Pins) > 0 {
+		for _, pin := range p.Pins {
+			if normalizePin(pin) == fingerprint {
+				return nil
+			}
+		}
+		return fmt.Errorf("certificate key %s of %s is not pinned", fingerprint, host)
+	}
+	if p.Store == nil {
+		return errors.New("CertPinning without Pins or Store")
+	}
+	if pin, ok := p.Store.Get(host); ok {
+		if normalizePin(pin) != fingerprint {
+			return fmt.Errorf("certificate key %s of %s does not match pinned key %s", fingerprint, host, pin)
+		}
+		return nil
+	}
+	return p.Store.Set(host, fingerprint)
+}
+
+// Returns the TLS configuration for a connection to host: a copy of
+// TLSConfig with ServerName defaulting to host, and the pinning check if
+// CertPinning is set. The check runs in VerifyConnection, which unlike
+// VerifyPeerCertificate also runs on resumed sessions.
+func (irc *Connection) tlsConfig(host string) *tls.Config {
+	config := &tls.Config{}
+	if irc.TLSConfig != nil {
+		config = irc.TLSConfig.Clone()
+	}
+	if config.ServerName == "" {
+		config.ServerName = host
+	}
+	if irc.CertPinning == nil {
+		return config
+	}
+	pinning, verify := irc.CertPinning, config.VerifyConnection
+	config.InsecureSkipVerify = true
+	config.VerifyConnection = func(cs tls.ConnectionState) error {
+		if err := pinning.verify(host, cs.PeerCertificates); err != nil {
+			return err
+		}
+		if verify != nil {
+			return verify(cs)
+		}
+		return nil
+	}
+	return config
+}
+
+// Path of a file in the configuration directory of the library. There is
+// no fallback to a shared directory like /tmp, where other users could
+// plant their own pins.
+func configPath(name string) (string, error) {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "go-ircevent", name), nil
+}
+
+var errNoPath = errors.New("no file Path set")
+
+// Read a JSON file into v, leaving v alone if the file does not exist.
+func loadJSON(path string, v interface{}) error {
+	if path == "" {
+		return errNoPath
+	}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// Write v to a JSON file, creating its directory if needed.
+func saveJSON(path string, v interface{}) error {
+	if path == "" {
+		return errNoPath
+	}
+	data, err := json.MarshalIndent(v, "", "\t")
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	// Write and rename so a crash never leaves a truncated file
+	tmp := path + ".tmp"
+	if err = ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
@@ -0,0 +1,171 @@
+package irc
+
+import (
+	"crypto"
+	"crypto/sha512"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"net"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Listen with TLS on a local port, using the certificate of httptest.
+// Returns the fingerprint of its key.
+func localTLSListener(t *testing.T) (net.Listener, string) {
+	s := httptest.NewTLSServer(nil)
+	config := s.TLS
+	s.Close()
+	l, err := tls.Listen("tcp", "127.0.0.1:0", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(config.Certificates[0].Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return l, SPKIFingerprint(cert)
+}
+
+func connectPinned(t *testing.T, addr string, pinning *CertPinning, config *tls.Config) error {
+	irccon := IRC("go-eventirc", "go-eventirc")
+	debugTest(irccon)
+	irccon.UseTLS = true
+	irccon.TLSConfig = config
+	irccon.CertPinning = pinning
+	err := irccon.Connect(addr)
+	if err == nil {
+		irccon.shutdown()
+	}
+	return err
+}
+
+func TestCertPinning(t *testing.T) {
+	l, fingerprint := localTLSListener(t)
+	defer l.Close()
+	lines := make(chan string, 100)
+	capServer(l, "", lines)
+	addr := l.Addr().String()
+
+	colons := strings.ToUpper(fingerprint[:2] + ":" + fingerprint[2:])
+	if err := connectPinned(t, addr, &CertPinning{Pins: []string{"00", colons}}, nil); err != nil {
+		t.Errorf("Pinned key refused: %s", err)
+	}
+	if err := connectPinned(t, addr, &CertPinning{Pins: []string{strings.Repeat("00", 32)}}, nil); err == nil {
+		t.Error("Wrong pin accepted")
+	}
+}
+
+func TestCertPinningResumed(t *testing.T) {
+	l, fingerprint := localTLSListener(t)
+	defer l.Close()
+	lines := make(chan string, 100)
+	capServer(l, "", lines)
+	addr := l.Addr().String()
+
+	config := &tls.Config{ClientSessionCache: tls.NewLRUClientSessionCache(1)}
+	irccon := IRC("go-eventirc", "go-eventirc")
+	debugTest(irccon)
+	irccon.UseTLS = true
+	irccon.TLSConfig = config
+	irccon.CertPinning = &CertPinning{Pins: []string{fingerprint}}
+	// Reading the answer to CAP LS stores the session ticket sent ahead
+	read := make(chan struct{}, 1)
+	irccon.AddCallback("CAP", func(e *Event) { read <- struct{}{} })
+	if err := irccon.Connect(addr); err != nil {
+		t.Fatalf("Pinned key refused: %s", err)
+	}
+	select {
+	case <-read:
+	case <-time.After(5 * time.Second):
+		t.Fatal("No CAP LS reply")
+	}
+	irccon.shutdown()
+
+	if err := connectPinned(t, addr, &CertPinning{Pins: []string{strings.Repeat("00", 32)}}, config); err == nil {
+		t.Error("Wrong pin accepted on a resumed session")
+	}
+}
+
+func TestCertPinningTOFU(t *testing.T) {
+	l, fingerprint := localTLSListener(t)
+	defer l.Close()
+	lines := make(chan string, 100)
+	capServer(l, "", lines)
+	addr := l.Addr().String()
+
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	store := &FilePinStore{Path: filepath.Join(dir, "pins.json")}
+
+	if err := connectPinned(t, addr, &CertPinning{Store: store}, nil); err != nil {
+		t.Fatalf("First connection refused: %s", err)
+	}
+	if pin, ok := store.Get("127.0.0.1"); !ok || pin != fingerprint {
+		t.Fatalf("Stored pin %q, %v", pin, ok)
+	}
+	if err := connectPinned(t, addr, &CertPinning{Store: store}, nil); err != nil {
+		t.Errorf("Known key refused: %s", err)
+	}
+	store.Set("127.0.0.1", strings.Repeat("00", 32))
+	if err := connectPinned(t, addr, &CertPinning{Store: store}, nil); err == nil {
+		t.Error("Changed key accepted")
+	}
+
+	if err := (&FilePinStore{}).Set("127.0.0.1", fingerprint); err == nil {
+		t.Error("Pin stored without a Path")
+	}
+}
+
+func TestCertFingerprint(t *testing.T) {
+	s := httptest.NewTLSServer(nil)
+	cert := s.TLS.Certificates[0]
+	s.Close()
+
+	sum := sha512.Sum512(cert.Certificate[0])
+	if fp, err := CertFingerprint(cert, crypto.SHA512); err != nil || fp != hex.EncodeToString(sum[:]) {
+		t.Errorf("CertFingerprint() = %q, %v", fp, err)
+	}
+	if _, err := CertFingerprint(tls.Certificate{}, crypto.SHA256); err == nil {
+		t.Error("Fingerprint of empty certificate")
+	}
+}
+
+func TestTLSVerification(t *testing.T) {
+	s := httptest.NewTLSServer(nil)
+	config, roots := s.TLS, x509.NewCertPool()
+	roots.AddCert(s.Certificate())
+	s.Close()
+	l, err := tls.Listen("tcp", "127.0.0.1:0", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	lines := make(chan string, 100)
+	capServer(l, "", lines)
+
+	irccon := IRC("go-eventirc", "go-eventirc")
+	debugTest(irccon)
+	irccon.UseTLS = true
+	irccon.TLSConfig = &tls.Config{RootCAs: roots}
+	if err := irccon.Connect(l.Addr().String()); err != nil {
+		t.Fatalf("Verified connection failed: %s", err)
+	}
+	irccon.shutdown()
+	if irccon.TLSConfig.ServerName != "" {
+		t.Error("TLSConfig modified")
+	}
+
+	irccon = IRC("go-eventirc", "go-eventirc")
+	debugTest(irccon)
+	irccon.UseTLS = true
+	irccon.TLSConfig = &tls.Config{}
+	if err := irccon.Connect(l.Addr().String()); err == nil {
+		irccon.shutdown()
+		t.Error("Certificate of unknown CA accepted")
+	}
+}
@@ -0,0 +1,105 @@
+package irc
+
+import (
+	"strings"
+)
+
+// Priority of an outgoing line. Lines of a higher priority are always sent
+// before lines of a lower priority waiting in the queue.
+type Priority int
+
+const (
+	PriorityHigh   Priority = iota //Protocol critical, e.g. PONG, CAP and AUTHENTICATE
+	PriorityNormal                 //Commands like JOIN, MODE or KICK
+	PriorityLow                    //Bulk messages: PRIVMSG, NOTICE and TAGMSG, and PART, NICK and QUIT, which stay in order with them
+	numPriorities
+)
+
+// Size of each outgoing queue
+const queueSize = 10
+
+// Returns the priority of a raw line based on its command.
+func linePriority(line string) Priority {
+	if strings.HasPrefix(line, "@") {
+		if i := strings.IndexByte(line, ' '); i > -1 {
+			line = line[i+1:]
+		}
+	}
+	if strings.HasPrefix(line, ":") {
+		if i := strings.IndexByte(line, ' '); i > -1 {
+			line = line[i+1:]
+		}
+	}
+	command := line
+	if i := strings.IndexAny(line, " \r\n"); i > -1 {
+		command = line[:i]
+	}
+	switch strings.ToUpper(command) {
+	case "PING", "PONG", "CAP", "AUTHENTICATE", "PASS", "WEBIRC", "USER":
+		return PriorityHigh
+	case "PRIVMSG", "NOTICE", "TAGMSG":
+		return PriorityLow
+	case "PART", "NICK", "QUIT":
+		// Messages queued before must still go to the channel, under the
+		// old nick, before we quit
+		return PriorityLow
+	}
+	return PriorityNormal
+}
+
+func (irc *Connection) makeQueues() {
+	for p := range irc.pwrite {
+		irc.pwrite[p] = make(chan string, queueSize)
+	}
+}
+
+func (irc *Connection) closeQueues() {
+	for _, queue := range irc.pwrite {
+		if queue != nil {
+			close(queue)
+		}
+	}
+}
+
+// Queue a line including the trailing CRLF for sending.
+func (irc *Connection) enqueue(line string) {
+	irc.pwrite[linePriority(line)] <- line
+}
+
+// Send a raw line with the given priority instead of the priority derived
+// from its command.
+func (irc *Connection) SendRawPriority(p Priority, message string) {
+	if p < PriorityHigh || p >= numPriorities {
+		p = PriorityNormal
+	}
+	irc.pwrite[p] <- message + "\r\n"
+}
+
+// Wait for the next line to send, taking the one with the highest priority
+// if several are queued. Returns false if the queues were closed or the
+// connection is ending.
+func (irc *Connection) nextLine() (string, bool) {
+	high, normal, low := irc.pwrite[PriorityHigh], irc.pwrite[PriorityNormal], irc.pwrite[PriorityLow]
+	select {
+	case b, ok := <-high:
+		return b, ok
+	default:
+	}
+	select {
+	case b, ok := <-high:
+		return b, ok
+	case b, ok := <-normal:
+		return b, ok
+	default:
+	}
+	select {
+	case b, ok := <-high:
+		return b, ok
+	case b, ok := <-normal:
+		return b, ok
+	case b, ok := <-low:
+		return b, ok
+	case <-irc.end:
+		return "", false
+	}
+}
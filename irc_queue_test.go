@@ -0,0 +1,76 @@
+package irc
+
+import (
+	"testing"
+)
+
+func TestLinePriority(t *testing.T) {
+	tests := map[string]Priority{
+		"PONG :server\r\n":                 PriorityHigh,
+		"CAP END\r\n":                      PriorityHigh,
+		"authenticate +\r\n":               PriorityHigh,
+		"QUIT\r\n":                         PriorityLow,
+		"NICK other\r\n":                   PriorityLow,
+		"PART #channel\r\n":                PriorityLow,
+		"JOIN #channel\r\n":                PriorityNormal,
+		"MODE #channel +o nick\r\n":        PriorityNormal,
+		"PRIVMSG #channel :hi\r\n":         PriorityLow,
+		"@+typing=active TAGMSG #channel":  PriorityLow,
+		":me NOTICE nick :\x01VERSION\x01": PriorityLow,
+	}
+	for line, p := range tests {
+		if linePriority(line) != p {
+			t.Errorf("linePriority(%q) = %d, want %d", line, linePriority(line), p)
+		}
+	}
+}
+
+func TestQueueOrder(t *testing.T) {
+	irccon := IRC("go-eventirc", "go-eventirc")
+	irccon.makeQueues()
+	irccon.Privmsg("#channel", "one")
+	irccon.Privmsg("#channel", "two")
+	irccon.Join("#channel")
+	irccon.SendRaw("PONG :server")
+	irccon.SendRawPriority(PriorityHigh, "PRIVMSG nick :urgent")
+
+	expected := []string{
+		"PONG :server\r\n",
+		"PRIVMSG nick :urgent\r\n",
+		"JOIN #channel\r\n",
+		"PRIVMSG #channel :one\r\n",
+		"PRIVMSG #channel :two\r\n",
+	}
+	for _, e := range expected {
+		if line, _ := irccon.nextLine(); line != e {
+			t.Fatalf("nextLine() = %q, want %q", line, e)
+		}
+	}
+}
+
+func TestQueueOrderQuit(t *testing.T) {
+	irccon := IRC("go-eventirc", "go-eventirc")
+	irccon.makeQueues()
+	irccon.Privmsg("#channel", "bye")
+	irccon.Part("#channel")
+	irccon.Privmsg("#other", "renaming")
+	irccon.Nick("other")
+	irccon.Privmsg("#other", "gone")
+	irccon.Quit()
+	irccon.SendRaw("PONG :server")
+
+	expected := []string{
+		"PONG :server\r\n",
+		"PRIVMSG #channel :bye\r\n",
+		"PART #channel\r\n",
+		"PRIVMSG #other :renaming\r\n",
+		"NICK other\r\n",
+		"PRIVMSG #other :gone\r\n",
+		"QUIT\r\n",
+	}
+	for _, e := range expected {
+		if line, _ := irccon.nextLine(); line != e {
+			t.Fatalf("nextLine() = %q, want %q", line, e)
+		}
+	}
+}
@@ -0,0 +1,88 @@
+package irc
+
+import (
+	"math"
+	"math/rand"
+	"time"
+)
+
+// A ReconnectPolicy decides whether and when Loop reconnects after the
+// connection was lost.
+type ReconnectPolicy interface {
+	// Called before every reconnect attempt. attempt is the number of
+	// consecutive failed reconnects so far, err is the error which caused
+	// the disconnect or made the last attempt fail. Returns how long to
+	// wait before the next attempt, or false to give up.
+	NextDelay(attempt int, err error) (time.Duration, bool)
+}
+
+// Reconnect immediately after a disconnect, then wait Delay between
+// failed attempts. Never gives up.
+type ConstantBackoff struct {
+	Delay time.Duration
+}
+
+func (b *ConstantBackoff) NextDelay(attempt int, err error) (time.Duration, bool) {
+	if attempt == 0 {
+		return 0, true
+	}
+	return b.Delay, true
+}
+
+// Reconnect immediately after a disconnect, then wait Min after the first
+// failed attempt, multiplying the delay by Factor after each further one up
+// to Max. Jitter is the fraction of each delay which is randomized to keep
+// many clients from reconnecting at the same time. Never gives up.
+type ExponentialBackoff struct {
+	Min    time.Duration //Defaults to 1s
+	Max    time.Duration
+	Factor float64 //Defaults to 2
+	Jitter float64 //Between 0 and 1
+}
+
+func (b *ExponentialBackoff) NextDelay(attempt int, err error) (time.Duration, bool) {
+	if attempt == 0 {
+		return 0, true
+	}
+	factor := b.Factor
+	if factor <= 1 {
+		factor = 2
+	}
+	min := b.Min
+	if min <= 0 {
+		min = time.Second
+	}
+	delay := float64(min) * math.Pow(factor, float64(attempt-1))
+	if b.Max > 0 && delay > float64(b.Max) {
+		delay = float64(b.Max)
+	}
+	if b.Jitter > 0 {
+		delay -= delay * math.Min(b.Jitter, 1) * rand.Float64()
+	}
+	return time.Duration(delay), true
+}
+
+// Give up after Max failed reconnect attempts, otherwise wait as long as
+// Policy says. A nil Policy reconnects without waiting.
+type MaxAttempts struct {
+	Policy ReconnectPolicy
+	Max    int
+}
+
+func (m *MaxAttempts) NextDelay(attempt int, err error) (time.Duration, bool) {
+	if attempt >= m.Max {
+		return 0, false
+	}
+	if m.Policy == nil {
+		return 0, true
+	}
+	return m.Policy.NextDelay(attempt, err)
+}
+
+// Returns the reconnect policy in effect.
+func (irc *Connection) reconnectPolicy() ReconnectPolicy {
+	if irc.ReconnectPolicy == nil {
+		return &ConstantBackoff{Delay: 60 * time.Second}
+	}
+	return irc.ReconnectPolicy
+}
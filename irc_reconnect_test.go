@@ -0,0 +1,152 @@
+package irc
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestConstantBackoff(t *testing.T) {
+	b := &ConstantBackoff{Delay: time.Second}
+	if d, ok := b.NextDelay(0, nil); d != 0 || !ok {
+		t.Errorf("First attempt: %s %v", d, ok)
+	}
+	if d, ok := b.NextDelay(5, nil); d != time.Second || !ok {
+		t.Errorf("Later attempt: %s %v", d, ok)
+	}
+}
+
+func TestExponentialBackoff(t *testing.T) {
+	b := &ExponentialBackoff{Min: time.Second, Max: 10 * time.Second}
+	expected := []time.Duration{0, time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second, 10 * time.Second}
+	for attempt, e := range expected {
+		if d, ok := b.NextDelay(attempt, nil); d != e || !ok {
+			t.Errorf("Attempt %d: %s %v, want %s", attempt, d, ok, e)
+		}
+	}
+
+	b.Jitter = 0.5
+	for i := 0; i < 100; i++ {
+		if d, _ := b.NextDelay(3, nil); d < 2*time.Second || d > 4*time.Second {
+			t.Fatalf("Delay with jitter out of range: %s", d)
+		}
+	}
+	if d, _ := (&ExponentialBackoff{}).NextDelay(1, nil); d != time.Second {
+		t.Errorf("Delay without Min: %s", d)
+	}
+}
+
+func TestMaxAttempts(t *testing.T) {
+	m := &MaxAttempts{Policy: &ConstantBackoff{Delay: time.Second}, Max: 2}
+	err := errors.New("connection refused")
+	if d, ok := m.NextDelay(1, err); d != time.Second || !ok {
+		t.Errorf("Attempt 1: %s %v", d, ok)
+	}
+	if _, ok := m.NextDelay(2, err); ok {
+		t.Error("MaxAttempts did not give up")
+	}
+}
+
+func TestLoopGivesUp(t *testing.T) {
+	l := localServer(t, func(conn net.Conn) {
+		conn.Close()
+	})
+
+	irccon := IRC("go-eventirc", "go-eventirc")
+	debugTest(irccon)
+	irccon.ReconnectPolicy = &MaxAttempts{Policy: &ConstantBackoff{Delay: 10 * time.Millisecond}, Max: 2}
+	if err := irccon.Connect(l.Addr().String()); err != nil {
+		t.Fatal(err)
+	}
+	// Make all reconnects fail
+	l.Close()
+
+	done := make(chan struct{})
+	go func() {
+		irccon.Loop()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Loop did not give up")
+	}
+	if irccon.Connected() {
+		t.Error("Connected after giving up")
+	}
+}
+
+func TestLifecycleEvents(t *testing.T) {
+	var connections int32
+	l := localServer(t, func(conn net.Conn) {
+		defer conn.Close()
+		first := atomic.AddInt32(&connections, 1) == 1
+		r := bufio.NewReader(conn)
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil || strings.HasPrefix(line, "QUIT") {
+				return
+			}
+			if strings.HasPrefix(line, "USER") {
+				conn.Write([]byte(":server 001 go-eventirc :Welcome\r\n"))
+				if first {
+					time.Sleep(50 * time.Millisecond)
+					return
+				}
+			}
+		}
+	})
+	defer l.Close()
+
+	irccon := IRC("go-eventirc", "go-eventirc")
+	debugTest(irccon)
+	events := make(chan *Event, 20)
+	for _, code := range []string{"CONNECTED", "REGISTERED", "DISCONNECTED", "RECONNECTING"} {
+		irccon.AddCallback(code, func(e *Event) { events <- e })
+	}
+	if err := irccon.Connect(l.Addr().String()); err != nil {
+		t.Fatal(err)
+	}
+	go irccon.Loop()
+
+	seen := map[string]int{}
+	for seen["REGISTERED"] < 2 {
+		select {
+		case e := <-events:
+			seen[e.Code]++
+			switch e.Code {
+			case "CONNECTED":
+				if e.Message() != l.Addr().String() {
+					t.Errorf("CONNECTED %v", e.Arguments)
+				}
+			case "DISCONNECTED":
+				if seen["RECONNECTING"] != 0 || len(e.Arguments) != 1 {
+					t.Errorf("DISCONNECTED %v", e.Arguments)
+				}
+			case "RECONNECTING":
+				if seen["DISCONNECTED"] != 1 || len(e.Arguments) != 3 || e.Arguments[0] != "1" || e.Arguments[1] != "0s" {
+					t.Errorf("RECONNECTING %v", e.Arguments)
+				}
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Missing events, got %v", seen)
+		}
+	}
+	if seen["CONNECTED"] != 2 || !irccon.Registered() {
+		t.Errorf("Got %v, registered %v", seen, irccon.Registered())
+	}
+
+	irccon.Quit()
+	select {
+	case e := <-events:
+		if e.Code != "DISCONNECTED" {
+			t.Errorf("Got %s after Quit", e.Code)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("No DISCONNECTED after Quit")
+	}
+}
@@ -0,0 +1,279 @@
+package irc
+
+import (
+	"sort"
+	"strings"
+	"time"
+)
+
+// A channel we joined, with the key needed to join it again.
+type joinedChannel struct {
+	Name string
+	Key  string
+}
+
+// Numerics with which a server refuses a JOIN, with the channel as
+// second argument.
+var joinErrors = []string{
+	"403", // ERR_NOSUCHCHANNEL
+	"405", // ERR_TOOMANYCHANNELS
+	"437", // ERR_UNAVAILRESOURCE, also sent for nicks
+	"471", // ERR_CHANNELISFULL
+	"473", // ERR_INVITEONLYCHAN
+	"474", // ERR_BANNEDFROMCHAN
+	"475", // ERR_BADCHANNELKEY
+	"477", // ERR_NEEDREGGEDNICK
+	"489", // ERR_SECUREONLYCHAN
+}
+
+// Returns the names of the channels we are in on this connection.
+func (irc *Connection) JoinedChannels() []string {
+	irc.joinedMutex.Lock()
+	defer irc.joinedMutex.Unlock()
+	channels := make([]string, 0, len(irc.joined))
+	for _, name := range irc.joined {
+		channels = append(channels, name)
+	}
+	sort.Strings(channels)
+	return channels
+}
+
+// Forget the channels we are in, the connection is gone. They are still
+// remembered for rejoining.
+func (irc *Connection) clearJoined() {
+	irc.joinedMutex.Lock()
+	irc.joined = make(map[string]string)
+	irc.joinedMutex.Unlock()
+}
+
+// Forget the rejoin in progress when the connection is lost, so no
+// REJOIN_FAILED is reported for it.
+func (irc *Connection) stopRejoin() {
+	irc.joinedMutex.Lock()
+	if irc.rejoinTimer != nil {
+		irc.rejoinTimer.Stop()
+		irc.rejoinTimer = nil
+	}
+	irc.rejoinPending, irc.rejoinFailed = nil, nil
+	irc.joinedMutex.Unlock()
+}
+
+// Remember the keys passed to Join so we can use them when rejoining.
+// channel is "<#channel>[,<#channel>...] [<key>[,<key>...]]".
+func (irc *Connection) rememberKeys(channel string) {
+	parts := strings.Fields(channel)
+	if len(parts) < 2 {
+		return
+	}
+	channels, keys := strings.Split(parts[0], ","), strings.Split(parts[1], ",")
+	irc.joinedMutex.Lock()
+	defer irc.joinedMutex.Unlock()
+	for i, key := range keys {
+		if i < len(channels) && key != "" {
+			irc.joinKeys[irc.CaseFold(channels[i])] = key
+		}
+	}
+}
+
+// Remember user modes we set on ourselves.
+func (irc *Connection) rememberUserModes(target string, modestring []string) {
+	if len(modestring) == 0 || !irc.EqualFold(target, irc.GetNick()) {
+		return
+	}
+	irc.joinedMutex.Lock()
+	irc.userModes = applyUserModes(irc.userModes, modestring[0])
+	irc.joinedMutex.Unlock()
+}
+
+// Mark yourself away with the given message, or back if it is empty.
+// RFC 1459 details: https://tools.ietf.org/html/rfc1459#section-5.1
+func (irc *Connection) Away(message string) {
+	irc.joinedMutex.Lock()
+	irc.awayMessage = message
+	irc.joinedMutex.Unlock()
+	if message == "" {
+		irc.SendRaw("AWAY")
+		return
+	}
+	irc.SendRawf("AWAY :%s", message)
+}
+
+// Rejoin channels, restore away status and user modes after registration.
+func (irc *Connection) restoreState() {
+	irc.joinedMutex.Lock()
+	channels := make([]joinedChannel, 0, len(irc.rejoin))
+	for _, ch := range irc.rejoin {
+		channels = append(channels, ch)
+	}
+	away, modes := irc.awayMessage, irc.userModes
+	irc.rejoinPending = make(map[string]string)
+	irc.rejoinFailed = nil
+	for _, ch := range channels {
+		irc.rejoinPending[irc.CaseFold(ch.Name)] = ch.Name
+	}
+	irc.joinedMutex.Unlock()
+
+	sort.Slice(channels, func(i, j int) bool { return channels[i].Name < channels[j].Name })
+	for _, ch := range channels {
+		if ch.Key != "" {
+			irc.SendRawf("JOIN %s %s", ch.Name, ch.Key)
+		} else {
+			irc.SendRawf("JOIN %s", ch.Name)
+		}
+	}
+	if modes != "" {
+		irc.SendRawf("MODE %s +%s", irc.GetNick(), modes)
+	}
+	if away != "" {
+		irc.SendRawf("AWAY :%s", away)
+	}
+
+	if len(channels) > 0 {
+		irc.joinedMutex.Lock()
+		if irc.rejoinTimer != nil {
+			irc.rejoinTimer.Stop()
+		}
+		irc.rejoinTimer = time.AfterFunc(irc.Timeout, func() { irc.rejoinDone("", true) })
+		irc.joinedMutex.Unlock()
+	}
+}
+
+// Note the outcome of rejoining a channel. Once all channels are done, or
+// when called with an empty channel after the timeout, the channels we
+// failed to rejoin are reported with a REJOIN_FAILED event. They are still
+// remembered and tried again after the next reconnect.
+func (irc *Connection) rejoinDone(channel string, failed bool) {
+	irc.joinedMutex.Lock()
+	if irc.rejoinPending == nil {
+		irc.joinedMutex.Unlock()
+		return
+	}
+	if channel == "" {
+		for _, name := range irc.rejoinPending {
+			irc.rejoinFailed = append(irc.rejoinFailed, name)
+		}
+		irc.rejoinPending = map[string]string{}
+	} else if name, ok := irc.rejoinPending[irc.CaseFold(channel)]; ok {
+		delete(irc.rejoinPending, irc.CaseFold(channel))
+		if failed {
+			irc.rejoinFailed = append(irc.rejoinFailed, name)
+		}
+	}
+	if len(irc.rejoinPending) > 0 {
+		irc.joinedMutex.Unlock()
+		return
+	}
+	failures := irc.rejoinFailed
+	irc.rejoinPending, irc.rejoinFailed = nil, nil
+	irc.joinedMutex.Unlock()
+
+	if len(failures) > 0 {
+		sort.Strings(failures)
+		irc.dispatch("REJOIN_FAILED", failures...)
+	}
+}
+
+// Set up callbacks tracking the channels we are in, joining AutoJoin and
+// restoring them after reconnecting if AutoRejoin is set.
+func (irc *Connection) setupRejoinCallbacks() {
+	irc.joined = make(map[string]string)
+	irc.rejoin = make(map[string]joinedChannel)
+	irc.joinKeys = make(map[string]string)
+
+	irc.AddCallback("001", func(e *Event) {
+		irc.clearJoined()
+		irc.joinedMutex.Lock()
+		irc.restored = false
+		irc.joinedMutex.Unlock()
+	})
+
+	// 376: RPL_ENDOFMOTD, 422: ERR_NOMOTD. Registration is complete.
+	restore := func(e *Event) {
+		irc.joinedMutex.Lock()
+		restored := irc.restored
+		irc.restored = true
+		irc.joinedMutex.Unlock()
+		if restored {
+			return
+		}
+		irc.autoJoin()
+		if irc.AutoRejoin {
+			irc.restoreState()
+		}
+	}
+	irc.AddCallback("376", restore)
+	irc.AddCallback("422", restore)
+
+	irc.AddCallback("JOIN", func(e *Event) {
+		if len(e.Arguments) == 0 || !irc.EqualFold(e.Nick, irc.GetNick()) {
+			return
+		}
+		name := e.Arguments[0]
+		key := irc.CaseFold(name)
+		irc.joinedMutex.Lock()
+		ch := joinedChannel{Name: name, Key: irc.joinKeys[key]}
+		if old, ok := irc.rejoin[key]; ok && ch.Key == "" {
+			ch.Key = old.Key
+		}
+		delete(irc.joinKeys, key)
+		irc.joined[key] = name
+		irc.rejoin[key] = ch
+		irc.joinedMutex.Unlock()
+		irc.rejoinDone(name, false)
+	})
+
+	forget := func(channel string) {
+		irc.joinedMutex.Lock()
+		delete(irc.joined, irc.CaseFold(channel))
+		delete(irc.rejoin, irc.CaseFold(channel))
+		irc.joinedMutex.Unlock()
+	}
+	irc.AddCallback("PART", func(e *Event) {
+		if len(e.Arguments) > 0 && irc.EqualFold(e.Nick, irc.GetNick()) {
+			forget(e.Arguments[0])
+		}
+	})
+	irc.AddCallback("KICK", func(e *Event) {
+		if len(e.Arguments) > 1 && irc.EqualFold(e.Arguments[1], irc.GetNick()) {
+			forget(e.Arguments[0])
+		}
+	})
+
+	// Keep track of channel keys being changed
+	irc.AddCallback("MODE", func(e *Event) {
+		if len(e.Arguments) < 2 || !irc.isChannel(e.Arguments[0]) {
+			return
+		}
+		key := irc.CaseFold(e.Arguments[0])
+		irc.joinedMutex.Lock()
+		defer irc.joinedMutex.Unlock()
+		ch, ok := irc.rejoin[key]
+		if !ok {
+			return
+		}
+		for _, c := range irc.parseChannelModes(e.Arguments[1], e.Arguments[2:]) {
+			if c.Mode == 'k' {
+				ch.Key = ""
+				if c.Add {
+					ch.Key = c.Param
+				}
+			}
+		}
+		irc.rejoin[key] = ch
+	})
+
+	// 305: RPL_UNAWAY. We are no longer away, don't restore it.
+	irc.AddCallback("305", func(e *Event) {
+		irc.joinedMutex.Lock()
+		irc.awayMessage = ""
+		irc.joinedMutex.Unlock()
+	})
+
+	for _, code := range joinErrors {
+		irc.AddCallback(code, func(e *Event) {
+			if len(e.Arguments) > 1 && irc.isChannel(e.Arguments[1]) {
+				irc.rejoinDone(e.Arguments[1], true)
+			}
+		})
+	}
+}
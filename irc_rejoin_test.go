@@ -0,0 +1,133 @@
+package irc
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestJoinedChannels(t *testing.T) {
+	irccon := IRC("go-eventirc", "go-eventirc")
+	irccon.makeQueues()
+	irccon.Join("#keyed,#open secret")
+	feed(t, irccon,
+		":server 001 go-eventirc :Welcome",
+		":go-eventirc!~go@host JOIN #keyed",
+		":go-eventirc!~go@host JOIN #open",
+		":go-eventirc!~go@host JOIN #gone",
+		":go-eventirc!~go@host JOIN #kicked",
+		":go-eventirc!~go@host PART #gone",
+		":op!~op@host KICK #kicked go-eventirc :out",
+		":op!~op@host MODE #open +k newkey",
+	)
+
+	if channels := irccon.JoinedChannels(); !reflect.DeepEqual(channels, []string{"#keyed", "#open"}) {
+		t.Fatalf("JoinedChannels() = %v", channels)
+	}
+	if ch := irccon.rejoin["#keyed"]; ch.Key != "secret" {
+		t.Errorf("Key of #keyed = %q", ch.Key)
+	}
+	if ch := irccon.rejoin["#open"]; ch.Key != "newkey" {
+		t.Errorf("Key of #open = %q", ch.Key)
+	}
+
+	// A new connection starts in no channels, but remembers them
+	feed(t, irccon, ":server 001 go-eventirc :Welcome")
+	if channels := irccon.JoinedChannels(); len(channels) != 0 {
+		t.Errorf("JoinedChannels() = %v after reconnecting", channels)
+	}
+	if _, ok := irccon.rejoin["#keyed"]; !ok {
+		t.Error("#keyed forgotten after reconnecting")
+	}
+}
+
+func TestAutoRejoin(t *testing.T) {
+	irccon := IRC("go-eventirc", "go-eventirc")
+	debugTest(irccon)
+	irccon.AutoRejoin = true
+	irccon.makeQueues()
+	feed(t, irccon, ":server 001 go-eventirc :Welcome")
+	irccon.Join("#keyed secret")
+	feed(t, irccon,
+		":go-eventirc!~go@host JOIN #keyed",
+		":go-eventirc!~go@host JOIN #banned",
+	)
+	irccon.Mode("go-eventirc", "+iw")
+	irccon.Mode("go-eventirc", "-w")
+	irccon.Away("gone")
+	for len(irccon.pwrite[PriorityNormal]) > 0 {
+		<-irccon.pwrite[PriorityNormal]
+	}
+
+	failed := make(chan []string, 1)
+	irccon.AddCallback("REJOIN_FAILED", func(e *Event) {
+		failed <- e.Arguments
+	})
+
+	// Reconnected
+	feed(t, irccon,
+		":server 001 go-eventirc :Welcome",
+		":server 376 go-eventirc :End of /MOTD command.",
+		":server 376 go-eventirc :End of /MOTD command.",
+	)
+	expected := []string{
+		"JOIN #banned\r\n",
+		"JOIN #keyed secret\r\n",
+		"MODE go-eventirc +i\r\n",
+		"AWAY :gone\r\n",
+	}
+	for _, e := range expected {
+		if line, _ := irccon.nextLine(); line != e {
+			t.Fatalf("nextLine() = %q, want %q", line, e)
+		}
+	}
+	if n := len(irccon.pwrite[PriorityNormal]); n != 0 {
+		t.Fatalf("%d more lines queued, state restored twice?", n)
+	}
+
+	feed(t, irccon,
+		":go-eventirc!~go@host JOIN #keyed",
+		":server 437 go-eventirc go-eventirc_ :Nick/channel is temporarily unavailable",
+		":server 474 go-eventirc #banned :Cannot join channel (+b)",
+	)
+	if channels := irccon.JoinedChannels(); !reflect.DeepEqual(channels, []string{"#keyed"}) {
+		t.Errorf("JoinedChannels() = %v after rejoining", channels)
+	}
+	select {
+	case channels := <-failed:
+		if !reflect.DeepEqual(channels, []string{"#banned"}) {
+			t.Errorf("REJOIN_FAILED %v", channels)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("No REJOIN_FAILED event")
+	}
+}
+
+func TestRejoinStopsOnDisconnect(t *testing.T) {
+	irccon := IRC("go-eventirc", "go-eventirc")
+	debugTest(irccon)
+	irccon.AutoRejoin = true
+	irccon.Timeout = 50 * time.Millisecond
+	irccon.makeQueues()
+	feed(t, irccon,
+		":server 001 go-eventirc :Welcome",
+		":go-eventirc!~go@host JOIN #channel",
+	)
+	failed := make(chan []string, 1)
+	irccon.AddCallback("REJOIN_FAILED", func(e *Event) {
+		failed <- e.Arguments
+	})
+
+	// Lost again while rejoining
+	feed(t, irccon,
+		":server 001 go-eventirc :Welcome",
+		":server 376 go-eventirc :End of /MOTD command.",
+	)
+	irccon.disconnected(errors.New("connection reset"))
+	select {
+	case channels := <-failed:
+		t.Errorf("REJOIN_FAILED %v after disconnecting", channels)
+	case <-time.After(4 * irccon.Timeout):
+	}
+}
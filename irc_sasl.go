@@ -1,10 +1,16 @@
 package irc
 
 import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"encoding/asn1"
 	"encoding/base64"
 	"errors"
 	"fmt"
+	"math/big"
 	"strings"
+	"time"
 )
 
 type SASLResult struct {
@@ -12,6 +18,106 @@ type SASLResult struct {
 	Err    error
 }
 
+// What to do when SASL authentication fails while connecting.
+type SASLFailurePolicy int
+
+const (
+	SASLAbort    SASLFailurePolicy = iota //Quit and return the error from Connect
+	SASLContinue                          //Register without logging in
+	SASLNickServ                          //Register and identify with NickServ IDENTIFY instead
+)
+
+// A SASLMechanism performs the client side of a SASL authentication. Set
+// Connection.SASLMechanism to use one, e.g. for OAUTHBEARER.
+type SASLMechanism interface {
+	// Called before each authentication. Returns the mechanism name
+	// sent with AUTHENTICATE.
+	Start() (string, error)
+	// Returns the response to a challenge of the server. The first
+	// challenge is empty. An error aborts the authentication.
+	Next(challenge []byte) ([]byte, error)
+}
+
+// A SASLMechanism that authenticates the server as well, like SCRAM,
+// implements SASLVerifier. RPL_SASLSUCCESS only counts as success once
+// Verified returns true.
+type SASLVerifier interface {
+	Verified() bool
+}
+
+// SASL PLAIN: the password is sent in the clear, only use it with TLS.
+type SASLPlain struct {
+	Login    string
+	Password string
+}
+
+func (p *SASLPlain) Start() (string, error) {
+	return "PLAIN", nil
+}
+
+func (p *SASLPlain) Next(challenge []byte) ([]byte, error) {
+	return []byte(fmt.Sprintf("%s\x00%s\x00%s", p.Login, p.Login, p.Password)), nil
+}
+
+// SASL EXTERNAL: the server authenticates us by our TLS client certificate.
+type SASLExternal struct{}
+
+func (SASLExternal) Start() (string, error) {
+	return "EXTERNAL", nil
+}
+
+func (SASLExternal) Next(challenge []byte) ([]byte, error) {
+	return nil, nil
+}
+
+// SASL ECDSA-NIST256P-CHALLENGE: we prove to own the private key whose
+// public key is registered with our account.
+type SASLECDSA struct {
+	Login string
+	Key   *ecdsa.PrivateKey
+	step  int
+}
+
+func (m *SASLECDSA) Start() (string, error) {
+	if m.Key == nil {
+		return "", errors.New("no ECDSA key")
+	}
+	m.step = 0
+	return "ECDSA-NIST256P-CHALLENGE", nil
+}
+
+func (m *SASLECDSA) Next(challenge []byte) ([]byte, error) {
+	m.step++
+	switch m.step {
+	case 1:
+		return []byte(m.Login), nil
+	case 2:
+		r, s, err := ecdsa.Sign(rand.Reader, m.Key, challenge)
+		if err != nil {
+			return nil, err
+		}
+		return asn1.Marshal(struct{ R, S *big.Int }{r, s})
+	}
+	return nil, errors.New("ECDSA-NIST256P-CHALLENGE exchange already finished")
+}
+
+// Returns the mechanism to authenticate with: SASLMechanism, or the one
+// named by SASLMech using SASLLogin and SASLPassword.
+func (irc *Connection) saslMechanism() (SASLMechanism, error) {
+	if irc.SASLMechanism != nil {
+		return irc.SASLMechanism, nil
+	}
+	switch irc.SASLMech {
+	case "PLAIN":
+		return &SASLPlain{Login: irc.SASLLogin, Password: irc.SASLPassword}, nil
+	case "EXTERNAL":
+		return SASLExternal{}, nil
+	case "SCRAM-SHA-1", "SCRAM-SHA-256", "SCRAM-SHA-512":
+		return &SASLSCRAM{Mechanism: irc.SASLMech, Login: irc.SASLLogin, Password: irc.SASLPassword}, nil
+	}
+	return nil, errors.New("only PLAIN, EXTERNAL and SCRAM-SHA-1/256/512 supported, set SASLMechanism for others")
+}
+
 // Check if a space-separated list of arguments contains a value.
 func listContains(list string, value string) bool {
 	for _, arg_name := range strings.Split(strings.TrimSpace(list), " ") {
@@ -22,59 +128,236 @@ func listContains(list string, value string) bool {
 	return false
 }
 
-func (irc *Connection) setupSASLCallbacks(result chan<- *SASLResult) (callbacks []CallbackID) {
-	id := irc.AddCallback("CAP", func(e *Event) {
-		if len(e.Arguments) == 3 {
-			if e.Arguments[1] == "LS" {
-				if !listContains(e.Arguments[2], "sasl") {
-					result <- &SASLResult{true, errors.New("no SASL capability " + e.Arguments[2])}
+// Maximum length of the base64 data in one AUTHENTICATE message.
+const saslChunkSize = 400
+
+// Send a SASL response base64 encoded, split into AUTHENTICATE messages.
+// A final + marks the end of data ending on a full chunk, or no data.
+func (irc *Connection) sendSASLResponse(response []byte) {
+	data := base64.StdEncoding.EncodeToString(response)
+	for len(data) >= saslChunkSize {
+		irc.SendRaw("AUTHENTICATE " + data[:saslChunkSize])
+		data = data[saslChunkSize:]
+	}
+	if data == "" {
+		data = "+"
+	}
+	irc.SendRaw("AUTHENTICATE " + data)
+}
+
+// Add the callbacks driving a SASL exchange, reporting its outcome on
+// result. With a nil mech, the exchange starts once the server acknowledges
+// the sasl capability and a failure ends the registration. Otherwise the
+// caller started mech and sends AUTHENTICATE itself.
+func (irc *Connection) setupSASLCallbacks(result chan<- *SASLResult, mech SASLMechanism) (callbacks []CallbackID) {
+	registering := mech == nil
+	report := func(res *SASLResult) {
+		select {
+		case result <- res:
+		default:
+		}
+	}
+	fail := func(err error) {
+		if registering && irc.SASLFailure == SASLAbort {
+			irc.SendRaw("CAP END")
+			irc.SendRaw("QUIT")
+		}
+		report(&SASLResult{true, err})
+	}
+	abort := func(err error) {
+		irc.SendRaw("AUTHENTICATE *")
+		fail(err)
+	}
+
+	var challenge string // Base64 data received so far
+	if registering {
+		id := irc.AddCallback("CAP", func(e *Event) {
+			if len(e.Arguments) == 3 {
+				if e.Arguments[1] == "NAK" && listContains(e.Arguments[2], "sasl") {
+					fail(errors.New("server refused the sasl capability"))
 				}
-			}
-			if e.Arguments[1] == "ACK" && listContains(e.Arguments[2], "sasl") {
-				if irc.SASLMech != "PLAIN" && irc.SASLMech != "EXTERNAL" {
-					result <- &SASLResult{true, errors.New("only PLAIN and EXTERNAL supported")}
+				if e.Arguments[1] == "ACK" && listContains(e.Arguments[2], "sasl") {
+					var err error
+					var name string
+					if mech, err = irc.saslMechanism(); err == nil {
+						name, err = mech.Start()
+					}
+					if err != nil {
+						fail(err)
+						return
+					}
+					irc.SendRaw("AUTHENTICATE " + name)
 				}
-				irc.SendRaw("AUTHENTICATE " + irc.SASLMech)
 			}
-		}
-	})
-	callbacks = append(callbacks, CallbackID{"CAP", id})
+		})
+		callbacks = append(callbacks, CallbackID{"CAP", id})
+	}
 
-	id = irc.AddCallback("AUTHENTICATE", func(e *Event) {
-		if irc.SASLMech == "EXTERNAL" {
-			irc.SendRaw("AUTHENTICATE +")
+	id := irc.AddCallback("AUTHENTICATE", func(e *Event) {
+		if len(e.Arguments) == 0 || mech == nil {
+			return
+		}
+		if chunk := e.Arguments[0]; chunk != "+" {
+			challenge += chunk
+			if len(chunk) == saslChunkSize {
+				return // More to come
+			}
+		}
+		data, err := base64.StdEncoding.DecodeString(challenge)
+		challenge = ""
+		if err != nil {
+			abort(err)
 			return
 		}
-		str := base64.StdEncoding.EncodeToString([]byte(fmt.Sprintf("%s\x00%s\x00%s", irc.SASLLogin, irc.SASLLogin, irc.SASLPassword)))
-		irc.SendRaw("AUTHENTICATE " + str)
+		response, err := mech.Next(data)
+		if err != nil {
+			abort(err)
+			return
+		}
+		irc.sendSASLResponse(response)
 	})
 	callbacks = append(callbacks, CallbackID{"AUTHENTICATE", id})
 
-	id = irc.AddCallback("901", func(e *Event) {
-		irc.SendRaw("CAP END")
-		irc.SendRaw("QUIT")
-		result <- &SASLResult{true, errors.New(e.Arguments[1])}
+	id = irc.AddCallback("903", func(e *Event) {
+		if v, ok := mech.(SASLVerifier); ok && !v.Verified() {
+			fail(errors.New("SASL server did not prove its identity"))
+			return
+		}
+		report(&SASLResult{false, nil})
 	})
-	callbacks = append(callbacks, CallbackID{"901", id})
+	callbacks = append(callbacks, CallbackID{"903", id})
 
-	id = irc.AddCallback("902", func(e *Event) {
-		irc.SendRaw("CAP END")
-		irc.SendRaw("QUIT")
-		result <- &SASLResult{true, errors.New(e.Arguments[1])}
-	})
-	callbacks = append(callbacks, CallbackID{"902", id})
+	// 902 ERR_NICKLOCKED, 904 ERR_SASLFAIL, 905 ERR_SASLTOOLONG,
+	// 907 ERR_SASLALREADY. 901 RPL_LOGGEDOUT is no failure, servers send it
+	// when switching accounts.
+	for _, code := range []string{"902", "904", "905", "907"} {
+		id = irc.AddCallback(code, func(e *Event) {
+			fail(errors.New(e.Message()))
+		})
+		callbacks = append(callbacks, CallbackID{code, id})
+	}
 
-	id = irc.AddCallback("903", func(e *Event) {
-		result <- &SASLResult{false, nil}
+	return
+}
+
+// Run a SASL exchange on a registered connection, e.g. to log in again
+// after rotating credentials or to switch accounts. The server must have
+// acknowledged the sasl capability. Unlike a failure while connecting, a
+// failure here leaves the connection open.
+func (irc *Connection) Reauthenticate(ctx context.Context) error {
+	if !irc.Registered() {
+		return errors.New("not registered")
+	}
+	if !irc.HasCap("sasl") {
+		return errors.New("no SASL capability")
+	}
+	irc.Lock()
+	if irc.authenticating {
+		irc.Unlock()
+		return errors.New("SASL authentication already in progress")
+	}
+	irc.authenticating = true
+	irc.Unlock()
+	defer func() {
+		irc.Lock()
+		irc.authenticating = false
+		irc.Unlock()
+	}()
+
+	mech, err := irc.saslMechanism()
+	if err != nil {
+		return err
+	}
+	name, err := mech.Start()
+	if err != nil {
+		return err
+	}
+	result := make(chan *SASLResult, 1)
+	callbacks := irc.setupSASLCallbacks(result, mech)
+	defer func() {
+		for _, callback := range callbacks {
+			irc.RemoveCallback(callback.EventCode, callback.ID)
+		}
+	}()
+
+	if err := irc.SendContext(ctx, "AUTHENTICATE "+name); err != nil {
+		return err
+	}
+	select {
+	case res := <-result:
+		return res.Err
+	case <-time.After(CAP_TIMEOUT):
+		irc.SendRaw("AUTHENTICATE *")
+		return errors.New("SASL authentication timed out")
+	case <-ctx.Done():
+		irc.SendRaw("AUTHENTICATE *")
+		return ctx.Err()
+	}
+}
+
+// Handle a SASL failure while connecting according to SASLFailure.
+// Returns the error to abort the connection with, nil to go on.
+func (irc *Connection) saslFailed(err error) error {
+	irc.dispatch("AUTH_FAILED", err.Error())
+	switch irc.SASLFailure {
+	case SASLContinue:
+		irc.Log.Printf("SASL authentication failed, continuing: %s\n", err)
+	case SASLNickServ:
+		if irc.SASLPassword == "" {
+			irc.Log.Printf("SASL authentication failed, cannot identify with NickServ without SASLPassword: %s\n", err)
+			break
+		}
+		irc.Log.Printf("SASL authentication failed, identifying with NickServ: %s\n", err)
+		irc.Lock()
+		irc.identify = true
+		irc.Unlock()
+	default:
+		return err
+	}
+	return nil
+}
+
+// Returns the account we are logged in to, or "" if we are not logged
+// in. Check it before joining channels that need authentication.
+func (irc *Connection) Account() string {
+	irc.Lock()
+	defer irc.Unlock()
+	return irc.account
+}
+
+func (irc *Connection) setupAccountCallbacks() {
+	// Fall back to NickServ once registered. IDENTIFY goes ahead of the
+	// JOINs of AutoJoin and AutoRejoin, even when flood control holds them.
+	irc.AddCallback("001", func(e *Event) {
+		irc.Lock()
+		identify := irc.identify
+		irc.identify = false
+		irc.Unlock()
+		if !identify {
+			return
+		}
+		if irc.SASLLogin != "" {
+			irc.SendRawPriority(PriorityHigh, fmt.Sprintf("PRIVMSG NickServ :IDENTIFY %s %s", irc.SASLLogin, irc.SASLPassword))
+		} else {
+			irc.SendRawPriority(PriorityHigh, "PRIVMSG NickServ :IDENTIFY "+irc.SASLPassword)
+		}
 	})
-	callbacks = append(callbacks, CallbackID{"903", id})
 
-	id = irc.AddCallback("904", func(e *Event) {
-		irc.SendRaw("CAP END")
-		irc.SendRaw("QUIT")
-		result <- &SASLResult{true, errors.New(e.Arguments[1])}
+	// 900: RPL_LOGGEDIN "<nick> <nick>!<ident>@<host> <account> :You are now logged in as <user>"
+	irc.AddCallback("900", func(e *Event) {
+		if len(e.Arguments) < 3 {
+			return
+		}
+		irc.Lock()
+		irc.account = e.Arguments[2]
+		irc.Unlock()
+		irc.dispatch("AUTHENTICATED", e.Arguments[2])
 	})
-	callbacks = append(callbacks, CallbackID{"904", id})
 
-	return
+	// 901: RPL_LOGGEDOUT "<nick> <nick>!<ident>@<host> :You are now logged out"
+	irc.AddCallback("901", func(e *Event) {
+		irc.Lock()
+		irc.account = ""
+		irc.Unlock()
+	})
 }
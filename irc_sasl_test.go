@@ -1,8 +1,17 @@
 package irc
 
 import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
 	"crypto/tls"
+	"encoding/asn1"
+	"encoding/base64"
+	"math/big"
 	"os"
+	"strings"
 	"testing"
 	"time"
 )
@@ -87,3 +96,251 @@ func TestConnectionSASLExternal(t *testing.T) {
 	}
 	irccon.Loop()
 }
+
+func TestSASLPlainExternal(t *testing.T) {
+	var mech SASLMechanism = &SASLPlain{Login: "user", Password: "pencil"}
+	name, err := mech.Start()
+	response, _ := mech.Next(nil)
+	if name != "PLAIN" || err != nil || string(response) != "user\x00user\x00pencil" {
+		t.Errorf("PLAIN: %q, %v, %q", name, err, response)
+	}
+	mech = SASLExternal{}
+	name, err = mech.Start()
+	response, _ = mech.Next(nil)
+	if name != "EXTERNAL" || err != nil || len(response) != 0 {
+		t.Errorf("EXTERNAL: %q, %v, %q", name, err, response)
+	}
+}
+
+func TestSASLECDSA(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mech := &SASLECDSA{Login: "user", Key: key}
+	if name, err := mech.Start(); name != "ECDSA-NIST256P-CHALLENGE" || err != nil {
+		t.Fatalf("Start() = %q, %v", name, err)
+	}
+	if response, err := mech.Next(nil); string(response) != "user" || err != nil {
+		t.Fatalf("Next() = %q, %v", response, err)
+	}
+	challenge := sha256.Sum256([]byte("challenge"))
+	response, err := mech.Next(challenge[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	var signature struct{ R, S *big.Int }
+	if _, err := asn1.Unmarshal(response, &signature); err != nil {
+		t.Fatal(err)
+	}
+	if !ecdsa.Verify(&key.PublicKey, challenge[:], signature.R, signature.S) {
+		t.Error("Invalid signature")
+	}
+	if _, err := (&SASLECDSA{Login: "user"}).Start(); err == nil {
+		t.Error("Started without key")
+	}
+}
+
+// A custom mechanism answering the challenge "ping" with "pong".
+type pingMechanism struct {
+	challenges []string
+}
+
+func (m *pingMechanism) Start() (string, error) {
+	return "X-PING", nil
+}
+
+func (m *pingMechanism) Next(challenge []byte) ([]byte, error) {
+	m.challenges = append(m.challenges, string(challenge))
+	if len(m.challenges) == 1 {
+		return nil, nil
+	}
+	return []byte("pong"), nil
+}
+
+func TestSASLCustomMechanism(t *testing.T) {
+	l := scriptServer(t, nil, func(line string) []string {
+		switch line {
+		case "CAP LS 302":
+			return []string{":server CAP * LS :sasl=X-PING"}
+		case "CAP REQ :sasl":
+			return []string{":server CAP go-eventirc ACK :sasl"}
+		case "AUTHENTICATE X-PING":
+			return []string{"AUTHENTICATE +"}
+		case "AUTHENTICATE +":
+			return []string{"AUTHENTICATE " + base64.StdEncoding.EncodeToString([]byte("ping"))}
+		case "AUTHENTICATE " + base64.StdEncoding.EncodeToString([]byte("pong")):
+			return []string{":server 903 go-eventirc :SASL authentication successful"}
+		}
+		return nil
+	})
+	defer l.Close()
+
+	mech := &pingMechanism{}
+	irccon := IRC("go-eventirc", "go-eventirc")
+	debugTest(irccon)
+	irccon.UseSASL = true
+	irccon.SASLMechanism = mech
+	if err := irccon.Connect(l.Addr().String()); err != nil {
+		t.Fatal(err)
+	}
+	defer irccon.shutdown()
+	if len(mech.challenges) != 2 || mech.challenges[0] != "" || mech.challenges[1] != "ping" {
+		t.Errorf("Challenges %q", mech.challenges)
+	}
+}
+
+func TestReauthenticate(t *testing.T) {
+	quit := make(chan bool, 1)
+	l := scriptServer(t, nil, func(line string) []string {
+		switch {
+		case line == "CAP LS 302":
+			return []string{":server CAP * LS :sasl=PLAIN"}
+		case line == "CAP REQ :sasl":
+			return []string{":server CAP go-eventirc ACK :sasl"}
+		case line == "AUTHENTICATE PLAIN":
+			return []string{"AUTHENTICATE +"}
+		case strings.HasPrefix(line, "AUTHENTICATE "):
+			msg, _ := base64.StdEncoding.DecodeString(strings.TrimPrefix(line, "AUTHENTICATE "))
+			fields := strings.Split(string(msg), "\x00")
+			switch {
+			case len(fields) == 3 && fields[2] == "locked":
+				return []string{":server 902 go-eventirc"}
+			case len(fields) == 3 && fields[2] == "pencil":
+				return []string{
+					":server 900 go-eventirc go-eventirc!user@host " + fields[1] + " :You are now logged in",
+					":server 903 go-eventirc :SASL authentication successful",
+				}
+			case len(fields) == 3 && fields[2] == "rotated":
+				// Switching accounts logs out of the old one first
+				return []string{
+					":server 901 go-eventirc go-eventirc!user@host :You are now logged out",
+					":server 900 go-eventirc go-eventirc!user@host " + fields[1] + " :You are now logged in",
+					":server 903 go-eventirc :SASL authentication successful",
+				}
+			}
+			return []string{":server 904 go-eventirc :SASL authentication failed"}
+		case strings.HasPrefix(line, "USER "):
+			return []string{":server 001 go-eventirc :Welcome"}
+		case strings.HasPrefix(line, "QUIT"):
+			quit <- true
+		}
+		return nil
+	})
+	defer l.Close()
+
+	irccon := IRC("go-eventirc", "go-eventirc")
+	debugTest(irccon)
+	irccon.UseSASL = true
+	irccon.SASLLogin = "user"
+	irccon.SASLPassword = "pencil"
+	registered := make(chan bool, 1)
+	irccon.AddCallback("REGISTERED", func(e *Event) { registered <- true })
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := irccon.Reauthenticate(ctx); err == nil {
+		t.Error("Reauthenticated before connecting")
+	}
+	if err := irccon.ConnectContext(ctx, l.Addr().String()); err != nil {
+		t.Fatal(err)
+	}
+	defer irccon.shutdown()
+	select {
+	case <-registered:
+	case <-ctx.Done():
+		t.Fatal("Not registered")
+	}
+
+	irccon.SASLPassword = "rotated"
+	if err := irccon.Reauthenticate(ctx); err != nil {
+		t.Errorf("Reauthenticate with new password: %v", err)
+	}
+	irccon.SASLPassword = "wrong"
+	if err := irccon.Reauthenticate(ctx); err == nil {
+		t.Error("Reauthenticated with wrong password")
+	}
+	irccon.SASLPassword = "locked"
+	if err := irccon.Reauthenticate(ctx); err == nil {
+		t.Error("Reauthenticated with locked nick")
+	}
+	select {
+	case <-quit:
+		t.Error("Connection closed after failed reauthentication")
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestSASLFailurePolicy(t *testing.T) {
+	lines := make(chan string, 100)
+	l := scriptServer(t, lines, func(line string) []string {
+		switch {
+		case line == "CAP LS 302":
+			return []string{":server CAP * LS :sasl=PLAIN"}
+		case line == "CAP REQ :sasl":
+			return []string{":server CAP go-eventirc ACK :sasl"}
+		case line == "AUTHENTICATE PLAIN":
+			return []string{"AUTHENTICATE +"}
+		case strings.HasPrefix(line, "AUTHENTICATE "):
+			return []string{":server 904 go-eventirc :SASL authentication failed"}
+		case strings.HasPrefix(line, "USER "):
+			return []string{":server 001 go-eventirc :Welcome", ":server 376 go-eventirc :End of /MOTD command."}
+		case line == "PRIVMSG NickServ :IDENTIFY user pencil":
+			return []string{":server 900 go-eventirc go-eventirc!user@host user :You are now logged in as user"}
+		}
+		return nil
+	})
+	defer l.Close()
+
+	irccon := IRC("go-eventirc", "go-eventirc")
+	debugTest(irccon)
+	irccon.UseSASL = true
+	irccon.SASLLogin = "user"
+	irccon.SASLPassword = "pencil"
+	irccon.SASLFailure = SASLNickServ
+	irccon.AutoJoin = []string{"#registered-only"}
+	irccon.FloodControl = &FloodControl{Burst: 1, Rate: 50 * time.Millisecond}
+	failed := make(chan string, 1)
+	irccon.AddCallback("AUTH_FAILED", func(e *Event) { failed <- e.Arguments[0] })
+	authenticated := make(chan string, 1)
+	irccon.AddCallback("AUTHENTICATED", func(e *Event) { authenticated <- e.Arguments[0] })
+	if err := irccon.Connect(l.Addr().String()); err != nil {
+		t.Fatal(err)
+	}
+	defer irccon.shutdown()
+	if reason := <-failed; reason != "SASL authentication failed" {
+		t.Errorf("AUTH_FAILED %q", reason)
+	}
+	expectLine(t, lines, "CAP END")
+	// IDENTIFY overtakes the JOIN held back by flood control
+	for line := ""; line != "PRIVMSG NickServ :IDENTIFY user pencil"; {
+		select {
+		case line = <-lines:
+			if strings.HasPrefix(line, "JOIN") {
+				t.Fatal("Joined before identifying")
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("No IDENTIFY sent")
+		}
+	}
+	expectLine(t, lines, "JOIN #registered-only")
+	select {
+	case account := <-authenticated:
+		if account != "user" || irccon.Account() != "user" {
+			t.Errorf("Logged in as %q, Account() = %q", account, irccon.Account())
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Not logged in")
+	}
+
+	// Without a fallback, a failure ends the connection
+	irccon = IRC("go-eventirc", "go-eventirc")
+	debugTest(irccon)
+	irccon.UseSASL = true
+	irccon.SASLLogin = "user"
+	irccon.SASLPassword = "pencil"
+	if err := irccon.Connect(l.Addr().String()); err == nil {
+		t.Error("Connected despite SASL failure")
+	}
+	expectLine(t, lines, "QUIT")
+	irccon.shutdown()
+}
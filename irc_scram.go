@@ -0,0 +1,142 @@
+package irc
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"errors"
+	"hash"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// Highest iteration count accepted from the server, so a hostile server
+// cannot keep us busy hashing.
+const scramMaxIterations = 1000000
+
+// SASL SCRAM, RFC 5802 and RFC 7677, without channel binding. Mechanism
+// is SCRAM-SHA-1, SCRAM-SHA-256 or SCRAM-SHA-512.
+type SASLSCRAM struct {
+	Mechanism string
+	Login     string
+	Password  string
+
+	newHash         func() hash.Hash
+	nonce           string
+	clientFirstBare string
+	serverSignature []byte
+	step            int
+	verified        bool
+}
+
+func (s *SASLSCRAM) Start() (string, error) {
+	switch s.Mechanism {
+	case "SCRAM-SHA-1":
+		s.newHash = sha1.New
+	case "SCRAM-SHA-256":
+		s.newHash = sha256.New
+	case "SCRAM-SHA-512":
+		s.newHash = sha512.New
+	default:
+		return "", errors.New("unknown SCRAM mechanism " + s.Mechanism)
+	}
+	s.nonce, s.step, s.verified = "", 0, false
+	return s.Mechanism, nil
+}
+
+// Escape a user name for SCRAM.
+func scramName(name string) string {
+	return strings.NewReplacer("=", "=3D", ",", "=2C").Replace(name)
+}
+
+// Split a SCRAM message into its attributes.
+func scramAttributes(msg string) map[byte]string {
+	attrs := make(map[byte]string)
+	for _, field := range strings.Split(msg, ",") {
+		if len(field) > 1 && field[1] == '=' {
+			attrs[field[0]] = field[2:]
+		}
+	}
+	return attrs
+}
+
+func (s *SASLSCRAM) Next(challenge []byte) ([]byte, error) {
+	s.step++
+	switch s.step {
+	case 1:
+		if s.nonce == "" {
+			buf := make([]byte, 18)
+			if _, err := rand.Read(buf); err != nil {
+				return nil, err
+			}
+			s.nonce = base64.RawStdEncoding.EncodeToString(buf)
+		}
+		s.clientFirstBare = "n=" + scramName(s.Login) + ",r=" + s.nonce
+		return []byte("n,," + s.clientFirstBare), nil
+
+	case 2:
+		serverFirst := string(challenge)
+		attrs := scramAttributes(serverFirst)
+		if e, ok := attrs['e']; ok {
+			return nil, errors.New("SCRAM server error: " + e)
+		}
+		nonce, salt64, iterations := attrs['r'], attrs['s'], attrs['i']
+		if !strings.HasPrefix(nonce, s.nonce) || len(nonce) == len(s.nonce) {
+			return nil, errors.New("SCRAM server nonce does not extend ours")
+		}
+		salt, err := base64.StdEncoding.DecodeString(salt64)
+		if err != nil {
+			return nil, errors.New("SCRAM salt is invalid")
+		}
+		iter, err := strconv.Atoi(iterations)
+		if err != nil || iter < 1 || iter > scramMaxIterations {
+			return nil, errors.New("SCRAM iteration count is invalid")
+		}
+
+		saltedPassword := pbkdf2.Key([]byte(s.Password), salt, iter, s.newHash().Size(), s.newHash)
+		clientKey := s.hmac(saltedPassword, "Client Key")
+		h := s.newHash()
+		h.Write(clientKey)
+		storedKey := h.Sum(nil)
+		serverKey := s.hmac(saltedPassword, "Server Key")
+
+		clientFinalBare := "c=biws,r=" + nonce // biws is base64 of n,,
+		authMessage := s.clientFirstBare + "," + serverFirst + "," + clientFinalBare
+		clientSignature := s.hmac(storedKey, authMessage)
+		proof := make([]byte, len(clientKey))
+		for i := range clientKey {
+			proof[i] = clientKey[i] ^ clientSignature[i]
+		}
+		s.serverSignature = s.hmac(serverKey, authMessage)
+		return []byte(clientFinalBare + ",p=" + base64.StdEncoding.EncodeToString(proof)), nil
+
+	case 3:
+		attrs := scramAttributes(string(challenge))
+		if e, ok := attrs['e']; ok {
+			return nil, errors.New("SCRAM server error: " + e)
+		}
+		signature, err := base64.StdEncoding.DecodeString(attrs['v'])
+		if err != nil || !hmac.Equal(signature, s.serverSignature) {
+			return nil, errors.New("SCRAM server signature is invalid")
+		}
+		s.verified = true
+		return []byte{}, nil
+	}
+	return nil, errors.New("SCRAM exchange already finished")
+}
+
+// Returns true once the server proved to know the password.
+func (s *SASLSCRAM) Verified() bool {
+	return s.verified
+}
+
+func (s *SASLSCRAM) hmac(key []byte, msg string) []byte {
+	mac := hmac.New(s.newHash, key)
+	mac.Write([]byte(msg))
+	return mac.Sum(nil)
+}
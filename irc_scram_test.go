@@ -0,0 +1,206 @@
+package irc
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/pbkdf2"
+)
+
+func TestSCRAMClient(t *testing.T) {
+	// RFC 5802 and RFC 7677 examples
+	tests := []struct {
+		mech, nonce, serverFirst, clientFinal, serverFinal string
+	}{
+		{
+			"SCRAM-SHA-1", "fyko+d2lbbFgONRv9qkxdawL",
+			"r=fyko+d2lbbFgONRv9qkxdawL3rfcNHYJY1ZVvWVs7j,s=QSXCR+Q6sek8bf92,i=4096",
+			"c=biws,r=fyko+d2lbbFgONRv9qkxdawL3rfcNHYJY1ZVvWVs7j,p=v0X8v3Bz2T0CJGbJQyF0X+HI4Ts=",
+			"v=rmF9pqV8S7suAoZWja4dJRkFsKQ=",
+		},
+		{
+			"SCRAM-SHA-256", "rOprNGfwEbeRWgbNEkqO",
+			"r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,s=W22ZaJ0SNY7soEsUEjb6gQ==,i=4096",
+			"c=biws,r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,p=dHzbZapWIk4jUhN+Ute9ytag9zjfMHgsqmmiz7AndVQ=",
+			"v=6rriTRBi23WpRR/wtup+mMhUZUn/dB5nLTJRsjl95G4=",
+		},
+	}
+	for _, test := range tests {
+		s := &SASLSCRAM{Mechanism: test.mech, Login: "user", Password: "pencil"}
+		if name, err := s.Start(); name != test.mech || err != nil {
+			t.Fatalf("Start() = %q, %v", name, err)
+		}
+		s.nonce = test.nonce
+		msg, err := s.Next(nil)
+		if err != nil || string(msg) != "n,,n=user,r="+test.nonce {
+			t.Fatalf("%s: client first %q, %v", test.mech, msg, err)
+		}
+		msg, err = s.Next([]byte(test.serverFirst))
+		if err != nil || string(msg) != test.clientFinal {
+			t.Fatalf("%s: client final %q, %v", test.mech, msg, err)
+		}
+		if s.Verified() {
+			t.Fatalf("%s: verified before server final", test.mech)
+		}
+		msg, err = s.Next([]byte(test.serverFinal))
+		if err != nil || len(msg) != 0 || !s.Verified() {
+			t.Fatalf("%s: after server final %q, %v", test.mech, msg, err)
+		}
+	}
+
+	s := &SASLSCRAM{Mechanism: "SCRAM-SHA-1", Login: "user", Password: "pencil"}
+	s.Start()
+	s.nonce = tests[0].nonce
+	s.Next(nil)
+	s.Next([]byte(tests[0].serverFirst))
+	if _, err := s.Next([]byte("v=AAAA")); err == nil || s.Verified() {
+		t.Error("Wrong server signature accepted")
+	}
+
+	s.Start()
+	s.nonce = tests[0].nonce
+	s.Next(nil)
+	if _, err := s.Next([]byte(strings.Replace(tests[0].serverFirst, "i=4096", "i=2000000000", 1))); err == nil {
+		t.Error("Huge iteration count accepted")
+	}
+	if _, err := (&SASLSCRAM{Mechanism: "SCRAM-MD5"}).Start(); err == nil {
+		t.Error("Unknown mechanism accepted")
+	}
+}
+
+// Server side of SCRAM-SHA-256 for user "user" with password "pencil".
+// A long salt makes the server first message span several AUTHENTICATE
+// lines. With badSignature, the server proves the wrong password. With
+// skipFinal, it reports success without proving anything.
+type scramServer struct {
+	badSignature bool
+	skipFinal    bool
+	salt         []byte
+	clientFirst  string
+	serverFirst  string
+}
+
+func (s *scramServer) mac(key []byte, msg string) []byte {
+	m := hmac.New(sha256.New, key)
+	m.Write([]byte(msg))
+	return m.Sum(nil)
+}
+
+func (s *scramServer) next(msg string) (string, error) {
+	if s.clientFirst == "" {
+		s.clientFirst = strings.TrimPrefix(msg, "n,,")
+		s.salt = bytes.Repeat([]byte("salt"), 100)
+		nonce := scramAttributes(s.clientFirst)['r'] + "server"
+		s.serverFirst = "r=" + nonce + ",s=" + base64.StdEncoding.EncodeToString(s.salt) + ",i=64"
+		return s.serverFirst, nil
+	}
+
+	password := "pencil"
+	if s.badSignature {
+		password = "wrong"
+	}
+	salted := pbkdf2.Key([]byte(password), s.salt, 64, sha256.Size, sha256.New)
+	i := strings.LastIndex(msg, ",p=")
+	authMessage := s.clientFirst + "," + s.serverFirst + "," + msg[:i]
+	clientKey := s.mac(salted, "Client Key")
+	storedKey := sha256.Sum256(clientKey)
+	signature := s.mac(storedKey[:], authMessage)
+	proof, _ := base64.StdEncoding.DecodeString(msg[i+3:])
+	for j := range proof {
+		proof[j] ^= signature[j]
+	}
+	if !s.badSignature && !bytes.Equal(proof, clientKey) {
+		return "", fmt.Errorf("wrong proof")
+	}
+	return "v=" + base64.StdEncoding.EncodeToString(s.mac(s.mac(salted, "Server Key"), authMessage)), nil
+}
+
+// Script for scriptServer authenticating with SCRAM-SHA-256. Reports the
+// final SASL numeric sent.
+func (s *scramServer) script(numerics chan<- string) func(line string) []string {
+	var data string
+	return func(line string) []string {
+		switch {
+		case line == "CAP LS 302":
+			return []string{":server CAP * LS :sasl=PLAIN,SCRAM-SHA-256"}
+		case line == "CAP REQ :sasl":
+			return []string{":server CAP go-eventirc ACK :sasl"}
+		case line == "AUTHENTICATE SCRAM-SHA-256":
+			return []string{"AUTHENTICATE +"}
+		case strings.HasPrefix(line, "AUTHENTICATE "):
+			chunk := strings.TrimPrefix(line, "AUTHENTICATE ")
+			if chunk == "*" {
+				numerics <- "906"
+				return nil
+			}
+			if chunk != "+" {
+				data += chunk
+				if len(chunk) == saslChunkSize {
+					return nil
+				}
+			}
+			msg, _ := base64.StdEncoding.DecodeString(data)
+			data = ""
+			if s.serverFirst != "" && len(msg) == 0 {
+				// Client accepted our signature
+				numerics <- "903"
+				return []string{":server 903 go-eventirc :SASL authentication successful"}
+			}
+			reply, err := s.next(string(msg))
+			if err == nil && s.skipFinal && strings.HasPrefix(reply, "v=") {
+				numerics <- "903"
+				return []string{":server 903 go-eventirc :SASL authentication successful"}
+			}
+			if err != nil {
+				numerics <- "904"
+				return []string{":server 904 go-eventirc :SASL authentication failed"}
+			}
+			var lines []string
+			reply = base64.StdEncoding.EncodeToString([]byte(reply))
+			for len(reply) >= saslChunkSize {
+				lines = append(lines, "AUTHENTICATE "+reply[:saslChunkSize])
+				reply = reply[saslChunkSize:]
+			}
+			if reply == "" {
+				reply = "+"
+			}
+			return append(lines, "AUTHENTICATE "+reply)
+		}
+		return nil
+	}
+}
+
+func TestSASLSCRAM(t *testing.T) {
+	for _, server := range []scramServer{{}, {badSignature: true}, {skipFinal: true}} {
+		server := server
+		numerics := make(chan string, 1)
+		l := scriptServer(t, nil, server.script(numerics))
+
+		irccon := IRC("go-eventirc", "go-eventirc")
+		debugTest(irccon)
+		irccon.UseSASL = true
+		irccon.SASLMech = "SCRAM-SHA-256"
+		irccon.SASLLogin = "user"
+		irccon.SASLPassword = "pencil"
+		err := irccon.Connect(l.Addr().String())
+		switch {
+		case server.badSignature:
+			if err == nil || <-numerics != "906" {
+				t.Errorf("Forged server signature: %v", err)
+			}
+		case server.skipFinal:
+			if err == nil {
+				t.Error("Success accepted without server signature")
+			}
+		case err != nil || <-numerics != "903":
+			t.Errorf("SCRAM authentication failed: %v", err)
+		}
+		irccon.shutdown()
+		l.Close()
+	}
+}
@@ -0,0 +1,111 @@
+package irc
+
+import (
+	"context"
+	"math/rand"
+	"net"
+	"net/url"
+	"strings"
+)
+
+// A server to connect to, for use in Connection.Servers.
+type Endpoint struct {
+	Server   string //host:port
+	UseTLS   bool
+	Password string //Server password, sent with PASS
+}
+
+// Returns the endpoint we are connected to, or were connected to last.
+func (irc *Connection) Endpoint() Endpoint {
+	irc.endpointMutex.Lock()
+	defer irc.endpointMutex.Unlock()
+	return irc.endpoint
+}
+
+func (irc *Connection) setEndpoint(ep Endpoint) {
+	irc.endpointMutex.Lock()
+	irc.endpoint = ep
+	irc.endpointMutex.Unlock()
+}
+
+// Returns the host of a server address, host:port or a ws:// or wss:// URL.
+func serverHost(server string) string {
+	if isWebSocketURL(server) {
+		if u, err := url.Parse(server); err == nil {
+			return u.Hostname()
+		}
+		return ""
+	}
+	if _, ok := unixPath(server); ok {
+		return ""
+	}
+	host, _, _ := net.SplitHostPort(server)
+	return host
+}
+
+// Returns and clears the endpoint the server redirected us to, if any.
+func (irc *Connection) takeRedirect() *Endpoint {
+	irc.endpointMutex.Lock()
+	defer irc.endpointMutex.Unlock()
+	redirect := irc.redirect
+	irc.redirect = nil
+	return redirect
+}
+
+// Clean up after a failed connection attempt so the next one starts fresh.
+func (irc *Connection) resetAfterFailure() {
+	if !irc.stopped {
+		irc.shutdown()
+	}
+	irc.end = make(chan struct{})
+}
+
+// Try the configured servers in order, or in random order if
+// RandomizeServers is set, until a connection succeeds.
+func (irc *Connection) connectServers(ctx context.Context) error {
+	order := make([]int, len(irc.Servers))
+	for i := range order {
+		order[i] = i
+	}
+	if irc.RandomizeServers {
+		order = rand.Perm(len(irc.Servers))
+	}
+
+	var err error
+	for _, i := range order {
+		ep := irc.Servers[i]
+		if err = irc.connect(ctx, ep); err == nil {
+			return nil
+		}
+		irc.Log.Printf("Error connecting to %s: %s\n", ep.Server, err)
+		irc.resetAfterFailure()
+		if ctx.Err() != nil {
+			return err
+		}
+	}
+	return err
+}
+
+// Set up the RPL_BOUNCE handler.
+func (irc *Connection) setupServerCallbacks() {
+	// 10: RPL_BOUNCE "<me> <hostname> <port> :<info>"
+	// A port prefixed with + asks for TLS. The server closes the connection
+	// afterwards, the next reconnect goes to the new server. The server
+	// password is not for the new server and stays behind.
+	irc.AddCallback("010", func(e *Event) {
+		if !irc.FollowRedirects || len(e.Arguments) < 3 {
+			return
+		}
+		host, port := e.Arguments[1], e.Arguments[2]
+		irc.endpointMutex.Lock()
+		defer irc.endpointMutex.Unlock()
+		redirect := irc.endpoint
+		redirect.Password = ""
+		if strings.HasPrefix(port, "+") {
+			redirect.UseTLS = true
+			port = port[1:]
+		}
+		redirect.Server = net.JoinHostPort(host, port)
+		irc.redirect = &redirect
+	})
+}
@@ -0,0 +1,129 @@
+package irc
+
+import (
+	"bufio"
+	"crypto/tls"
+	"net"
+	"testing"
+	"time"
+)
+
+// Address of a local port nobody listens on.
+func closedAddr(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+	return addr
+}
+
+// Server which reports the first line it receives.
+func firstLineServer(t *testing.T, lines chan<- string) net.Listener {
+	return localServer(t, func(conn net.Conn) {
+		defer conn.Close()
+		line, err := bufio.NewReader(conn).ReadString('\n')
+		if err == nil {
+			lines <- line
+		}
+	})
+}
+
+func TestConnectFailover(t *testing.T) {
+	lines := make(chan string, 1)
+	l := firstLineServer(t, lines)
+	defer l.Close()
+
+	irccon := IRC("go-eventirc", "go-eventirc")
+	debugTest(irccon)
+	irccon.Servers = []Endpoint{
+		{Server: closedAddr(t), Password: "first"},
+		{Server: l.Addr().String(), Password: "second"},
+	}
+	if err := irccon.Connect(""); err != nil {
+		t.Fatal(err)
+	}
+	defer irccon.shutdown()
+
+	if irccon.Endpoint().Server != l.Addr().String() || irccon.Server != l.Addr().String() {
+		t.Errorf("Connected to %s", irccon.Endpoint().Server)
+	}
+	select {
+	case line := <-lines:
+		if line != "PASS second\r\n" {
+			t.Errorf("Server got %q", line)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Nothing received")
+	}
+}
+
+func TestConnectFailoverAllFail(t *testing.T) {
+	irccon := IRC("go-eventirc", "go-eventirc")
+	debugTest(irccon)
+	irccon.Servers = []Endpoint{{Server: closedAddr(t)}, {Server: closedAddr(t)}}
+	irccon.RandomizeServers = true
+	if err := irccon.Connect(""); err == nil {
+		t.Fatal("Connect succeeded without a server")
+	}
+}
+
+func TestFollowRedirect(t *testing.T) {
+	// The target reports the first line of each connection and hangs up
+	target, _ := localTLSListener(t)
+	defer target.Close()
+	lines := make(chan string, 10)
+	go func() {
+		for {
+			conn, err := target.Accept()
+			if err != nil {
+				return
+			}
+			line, err := bufio.NewReader(conn).ReadString('\n')
+			if err == nil {
+				lines <- line
+			}
+			conn.Close()
+		}
+	}()
+	host, port, _ := net.SplitHostPort(target.Addr().String())
+
+	origin := make(chan struct{}, 10)
+	l := localServer(t, func(conn net.Conn) {
+		origin <- struct{}{}
+		conn.Write([]byte(":server 010 go-eventirc " + host + " +" + port + " :Go away\r\n"))
+		time.Sleep(100 * time.Millisecond)
+		conn.Close()
+	})
+	defer l.Close()
+
+	irccon := IRC("go-eventirc", "go-eventirc")
+	debugTest(irccon)
+	irccon.FollowRedirects = true
+	irccon.Password = "secret"
+	irccon.TLSConfig = &tls.Config{InsecureSkipVerify: true}
+	if err := irccon.Connect(l.Addr().String()); err != nil {
+		t.Fatal(err)
+	}
+	go irccon.Loop()
+	defer irccon.Quit()
+
+	// Followed without the password, and kept on reconnecting
+	for i := 0; i < 2; i++ {
+		select {
+		case line := <-lines:
+			if line != "CAP LS 302\r\n" {
+				t.Errorf("Redirect target got %q", line)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Redirect not followed on connection %d", i+1)
+		}
+	}
+	if len(origin) != 1 {
+		t.Errorf("Connected %d times to the redirecting server", len(origin))
+	}
+	if ep := irccon.Endpoint(); !ep.UseTLS || ep.Password != "" {
+		t.Errorf("Redirected to %+v", ep)
+	}
+}
@@ -0,0 +1,257 @@
+package irc
+
+import (
+	"strings"
+	"unicode/utf8"
+)
+
+// Longest host name we expect if the server has not told us our host yet.
+const maxHostLen = 63
+
+// IRC formatting state, used to carry formatting over to the next line
+// when splitting a message.
+type formatState struct {
+	bold, italic, underline, strikethrough, monospace, reverse bool
+	color                                                      string //"fg" or "fg,bg" with two digits each
+}
+
+// Returns the codes needed to restore the formatting state at the start of a line.
+func (f *formatState) codes() string {
+	var b strings.Builder
+	if f.bold {
+		b.WriteByte('\x02')
+	}
+	if f.italic {
+		b.WriteByte('\x1D')
+	}
+	if f.underline {
+		b.WriteByte('\x1F')
+	}
+	if f.strikethrough {
+		b.WriteByte('\x1E')
+	}
+	if f.monospace {
+		b.WriteByte('\x11')
+	}
+	if f.reverse {
+		b.WriteByte('\x16')
+	}
+	if f.color != "" {
+		b.WriteByte('\x03')
+		b.WriteString(f.color)
+	}
+	return b.String()
+}
+
+// Update the formatting state with all codes in s.
+func (f *formatState) apply(s string) {
+	for i := 0; i < len(s); {
+		end := nextToken(s, i)
+		switch s[i] {
+		case '\x02':
+			f.bold = !f.bold
+		case '\x1D':
+			f.italic = !f.italic
+		case '\x1F':
+			f.underline = !f.underline
+		case '\x1E':
+			f.strikethrough = !f.strikethrough
+		case '\x11':
+			f.monospace = !f.monospace
+		case '\x16':
+			f.reverse = !f.reverse
+		case '\x0F':
+			*f = formatState{}
+		case '\x03':
+			f.setColor(s[i+1 : end])
+		}
+		i = end
+	}
+}
+
+// Set the color from the digits following \x03. No digits reset the color,
+// a missing background keeps the current one.
+func (f *formatState) setColor(spec string) {
+	if spec == "" {
+		f.color = ""
+		return
+	}
+	pad := func(n string) string {
+		if len(n) == 1 {
+			return "0" + n
+		}
+		return n
+	}
+	parts := strings.SplitN(spec, ",", 2)
+	color := pad(parts[0])
+	if len(parts) == 2 {
+		color += "," + pad(parts[1])
+	} else if i := strings.IndexByte(f.color, ','); i > -1 {
+		color += f.color[i:]
+	}
+	f.color = color
+}
+
+// Returns the end of the token starting at s[i]: a whole color code
+// including its digits, or a single rune.
+func nextToken(s string, i int) int {
+	if s[i] != '\x03' {
+		_, size := utf8.DecodeRuneInString(s[i:])
+		return i + size
+	}
+	j := i + 1
+	digits := func() {
+		for n := 0; n < 2 && j < len(s) && s[j] >= '0' && s[j] <= '9'; n++ {
+			j++
+		}
+	}
+	digits()
+	if j > i+1 && j+1 < len(s) && s[j] == ',' && s[j+1] >= '0' && s[j+1] <= '9' {
+		j++
+		digits()
+	}
+	return j
+}
+
+// Find where to cut s so the first part is at most max bytes long.
+// Prefers the last space, otherwise cuts between runes or color codes.
+// Returns the cut position and where the remainder starts.
+func cutPoint(s string, max int) (cut, next int) {
+	lastSpace, lastToken := -1, 0
+	for i := 0; i < len(s); {
+		end := nextToken(s, i)
+		if s[i] == ' ' && i > 0 {
+			lastSpace = i
+		}
+		if end > max {
+			break
+		}
+		lastToken = end
+		i = end
+	}
+	if lastSpace > 0 {
+		return lastSpace, lastSpace + 1
+	}
+	if lastToken == 0 {
+		// Not even a single token fits, cut after it anyway to make progress
+		lastToken = nextToken(s, 0)
+	}
+	return lastToken, lastToken
+}
+
+// Split a message into lines of at most max bytes. Embedded line breaks,
+// \r\n, \r or \n, start a new line, empty lines are dropped. Long lines are split at word
+// boundaries if possible, and never inside a UTF-8 character or color
+// code. Formatting active at a split is restored on the next line.
+func splitMessage(message string, max int) []string {
+	var lines []string
+	message = strings.NewReplacer("\r\n", "\n", "\r", "\n").Replace(message)
+	for _, line := range strings.Split(message, "\n") {
+		var f formatState
+		for line != "" {
+			codes := f.codes()
+			if len(codes)+len(line) <= max {
+				lines = append(lines, codes+line)
+				break
+			}
+			cut, next := cutPoint(line, max-len(codes))
+			lines = append(lines, codes+line[:cut])
+			f.apply(line[:cut])
+			line = line[next:]
+		}
+	}
+	return lines
+}
+
+// Returns the longest text that fits in a command to target, taking into
+// account the prefix the server adds when relaying it to others.
+// overhead is the number of bytes the caller adds to the text, e.g. for CTCP.
+func (irc *Connection) maxMessageLen(command, target string, overhead int) int {
+	irc.prefixMutex.Lock()
+	prefix := irc.prefix
+	irc.prefixMutex.Unlock()
+	if prefix == "" {
+		// Assume the worst until we know how the server sees us
+		prefix = irc.GetNick() + "!~" + irc.user + "@" + strings.Repeat("x", maxHostLen)
+	}
+
+	// :<prefix> <command> <target> :<text>\r\n
+	max := irc.ISupport().LineLen - len(prefix) - len(command) - len(target) - overhead - 7
+	if max < 32 {
+		max = 32
+	}
+	return max
+}
+
+// Send a PRIVMSG or NOTICE, split into as many lines as necessary.
+// ctcp is the CTCP command the text is wrapped in, if any.
+func (irc *Connection) sendSplit(command, target, ctcp, message string) {
+	overhead := 0
+	if ctcp != "" {
+		overhead = len(ctcp) + 3
+	}
+	lines := splitMessage(message, irc.maxMessageLen(command, target, overhead))
+	if len(lines) == 0 {
+		lines = []string{""}
+	}
+	for _, line := range lines {
+		if ctcp != "" {
+			line = "\x01" + ctcp + " " + line + "\x01"
+		}
+		irc.enqueue(command + " " + target + " :" + line + "\r\n")
+	}
+}
+
+func (irc *Connection) setPrefix(prefix string) {
+	irc.prefixMutex.Lock()
+	irc.prefix = prefix
+	irc.prefixMutex.Unlock()
+}
+
+// Set up callbacks learning our nick!user@host as seen by the server.
+func (irc *Connection) setupPrefixCallbacks() {
+	// 1: RPL_WELCOME "Welcome to the Internet Relay Network <nick>!<user>@<host>"
+	irc.AddCallback("001", func(e *Event) {
+		irc.setPrefix("")
+		fields := strings.Fields(e.Message())
+		if len(fields) == 0 {
+			return
+		}
+		prefix := fields[len(fields)-1]
+		if i, j := strings.Index(prefix, "!"), strings.Index(prefix, "@"); i > 0 && j > i {
+			irc.setPrefix(prefix)
+		}
+	})
+
+	// Our own JOIN echo always carries the full prefix.
+	irc.AddCallback("JOIN", func(e *Event) {
+		if e.Host != "" && irc.EqualFold(e.Nick, irc.GetNick()) {
+			irc.setPrefix(e.Source)
+		}
+	})
+
+	irc.AddCallback("NICK", func(e *Event) {
+		irc.prefixMutex.Lock()
+		defer irc.prefixMutex.Unlock()
+		if i := strings.Index(irc.prefix, "!"); i > -1 && irc.EqualFold(e.Nick, irc.prefix[:i]) {
+			irc.prefix = e.Message() + irc.prefix[i:]
+		}
+	})
+
+	// 396: RPL_HOSTHIDDEN "<me> <host> :is now your displayed host"
+	irc.AddCallback("396", func(e *Event) {
+		if len(e.Arguments) < 3 {
+			return
+		}
+		irc.prefixMutex.Lock()
+		defer irc.prefixMutex.Unlock()
+		host := e.Arguments[1]
+		if strings.Contains(host, "@") {
+			if i := strings.Index(irc.prefix, "!"); i > -1 {
+				irc.prefix = irc.prefix[:i+1] + host
+			}
+		} else if i := strings.Index(irc.prefix, "@"); i > -1 {
+			irc.prefix = irc.prefix[:i+1] + host
+		}
+	})
+}
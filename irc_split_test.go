@@ -0,0 +1,92 @@
+package irc
+
+import (
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestSplitMessageShort(t *testing.T) {
+	lines := splitMessage("hello world", 100)
+	if len(lines) != 1 || lines[0] != "hello world" {
+		t.Fatalf("lines = %q", lines)
+	}
+}
+
+func TestSplitMessageNewlines(t *testing.T) {
+	lines := splitMessage("one\r\ntwo\n\nthree\n", 100)
+	if strings.Join(lines, "|") != "one|two|three" {
+		t.Fatalf("lines = %q", lines)
+	}
+	lines = splitMessage("hi\rQUIT :injected\r\r\nbye", 100)
+	if strings.Join(lines, "|") != "hi|QUIT :injected|bye" {
+		t.Fatalf("lines = %q", lines)
+	}
+}
+
+func TestSplitMessageWords(t *testing.T) {
+	lines := splitMessage("the quick brown fox jumps", 10)
+	if strings.Join(lines, "|") != "the quick|brown fox|jumps" {
+		t.Fatalf("lines = %q", lines)
+	}
+}
+
+func TestSplitMessageRunes(t *testing.T) {
+	message := strings.Repeat("ä€😀", 20)
+	lines := splitMessage(message, 10)
+	for _, line := range lines {
+		if len(line) > 10 {
+			t.Errorf("Line %q too long", line)
+		}
+		if !utf8.ValidString(line) {
+			t.Errorf("Line %q split inside a rune", line)
+		}
+	}
+	if strings.Join(lines, "") != message {
+		t.Error("Text lost while splitting")
+	}
+}
+
+func TestSplitMessageFormatting(t *testing.T) {
+	lines := splitMessage("\x02bold \x034,2red\x0F plain", 12)
+	if strings.Join(lines, "|") != "\x02bold|\x02\x034,2red\x0F|plain" {
+		t.Fatalf("lines = %q", lines)
+	}
+	lines = splitMessage("\x0312"+strings.Repeat("x", 20), 10)
+	if lines[0] != "\x0312xxxxxxx" || lines[1] != "\x0312xxxxxxx" {
+		t.Fatalf("lines = %q", lines)
+	}
+	// Never split a color code from its digits
+	lines = splitMessage("abcdefg\x0312,05x", 9)
+	if lines[0] != "abcdefg" || lines[1] != "\x0312,05x" {
+		t.Fatalf("lines = %q", lines)
+	}
+}
+
+func TestPrivmsgSplit(t *testing.T) {
+	irccon := IRC("go-eventirc", "go-eventirc")
+	irccon.makeQueues()
+	feed(t, irccon, ":server 001 go-eventirc :Welcome to the Internet Relay Network go-eventirc!~go@example.com")
+
+	max := irccon.maxMessageLen("PRIVMSG", "#channel", 0)
+	prefix := ":go-eventirc!~go@example.com "
+	if len(prefix)+len("PRIVMSG #channel :")+max+2 != 512 {
+		t.Fatalf("maxMessageLen = %d", max)
+	}
+
+	irccon.Privmsg("#channel", strings.Repeat("word ", 200))
+	irccon.closeQueues()
+	n := 0
+	for line := range irccon.pwrite[PriorityLow] {
+		n++
+		if len(prefix)+len(line) > 512 {
+			t.Errorf("Line of %d bytes exceeds limit", len(prefix)+len(line))
+		}
+		if !strings.HasPrefix(line, "PRIVMSG #channel :word") || !strings.HasSuffix(line, "\r\n") {
+			t.Errorf("Unexpected line %q", line)
+		}
+	}
+	if n != 3 {
+		t.Errorf("Expected 3 lines, got %d", n)
+	}
+}
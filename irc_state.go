@@ -0,0 +1,513 @@
+package irc
+
+import (
+	"sort"
+	"strings"
+	"sync"
+)
+
+// A member of a channel as seen by the state tracker.
+type Member struct {
+	Nick     string
+	User     string //Empty unless known from a JOIN or userhost-in-names
+	Host     string
+	Prefixes string //Channel membership prefixes, highest first. E.g. "@+"
+
+	opSymbols string //Prefixes of operator status or higher, from PREFIX
+}
+
+// Returns true if the member has channel operator status or higher.
+func (m *Member) IsOp() bool {
+	ops := m.opSymbols
+	if ops == "" {
+		ops = "~&@"
+	}
+	return strings.ContainsAny(m.Prefixes, ops)
+}
+
+// Returns true if the member has voice.
+func (m *Member) IsVoice() bool {
+	return strings.Contains(m.Prefixes, "+")
+}
+
+// A channel we are in as seen by the state tracker.
+type Channel struct {
+	Name    string
+	Topic   string
+	Modes   map[byte]string    //Channel modes with their parameter, if any. List modes are not tracked.
+	Members map[string]*Member //Keyed by the case folded nick, see Connection.CaseFold
+}
+
+func (c *Channel) copy() *Channel {
+	ch := &Channel{
+		Name:    c.Name,
+		Topic:   c.Topic,
+		Modes:   make(map[byte]string, len(c.Modes)),
+		Members: make(map[string]*Member, len(c.Members)),
+	}
+	for mode, param := range c.Modes {
+		ch.Modes[mode] = param
+	}
+	for nick, member := range c.Members {
+		m := *member
+		ch.Members[nick] = &m
+	}
+	return ch
+}
+
+// State keeps track of the channels we are in, their members, topics and
+// modes, and our own user modes. It is maintained from the events dispatched
+// by RunCallbacks when Connection.TrackState is set. All methods are safe for
+// concurrent use and return copies which are not updated afterwards.
+type State struct {
+	sync.RWMutex
+	irc       *Connection
+	channels  map[string]*Channel
+	names     map[string]map[string]*Member //NAMES replies in progress
+	userModes string
+}
+
+func newState(irc *Connection) *State {
+	s := &State{irc: irc}
+	s.reset()
+	return s
+}
+
+func (s *State) reset() {
+	s.Lock()
+	s.channels = make(map[string]*Channel)
+	s.names = make(map[string]map[string]*Member)
+	s.userModes = ""
+	s.Unlock()
+}
+
+// Returns the names of all channels we are in.
+func (s *State) Channels() []string {
+	s.RLock()
+	defer s.RUnlock()
+	channels := make([]string, 0, len(s.channels))
+	for _, ch := range s.channels {
+		channels = append(channels, ch.Name)
+	}
+	sort.Strings(channels)
+	return channels
+}
+
+// Returns a snapshot of a channel, or false if we are not in it.
+func (s *State) Channel(name string) (*Channel, bool) {
+	s.RLock()
+	defer s.RUnlock()
+	ch, ok := s.channels[s.irc.CaseFold(name)]
+	if !ok {
+		return nil, false
+	}
+	return ch.copy(), true
+}
+
+// Returns a snapshot of a channel member, or false if the nick is not in the channel.
+func (s *State) Member(channel, nick string) (*Member, bool) {
+	s.RLock()
+	defer s.RUnlock()
+	ch, ok := s.channels[s.irc.CaseFold(channel)]
+	if !ok {
+		return nil, false
+	}
+	member, ok := ch.Members[s.irc.CaseFold(nick)]
+	if !ok {
+		return nil, false
+	}
+	m := *member
+	return &m, true
+}
+
+// Returns true if nick is in the given channel.
+func (s *State) IsOn(channel, nick string) bool {
+	_, ok := s.Member(channel, nick)
+	return ok
+}
+
+// Returns our own user modes, e.g. "iw".
+func (s *State) UserModes() string {
+	s.RLock()
+	defer s.RUnlock()
+	return s.userModes
+}
+
+// Returns a snapshot of all channels we are in, keyed by the case folded name.
+func (s *State) Snapshot() map[string]*Channel {
+	s.RLock()
+	defer s.RUnlock()
+	channels := make(map[string]*Channel, len(s.channels))
+	for key, ch := range s.channels {
+		channels[key] = ch.copy()
+	}
+	return channels
+}
+
+// Returns the state tracker, or nil if TrackState is not set.
+func (irc *Connection) State() *State {
+	if !irc.TrackState {
+		return nil
+	}
+	return irc.state
+}
+
+// A single mode being set or unset, with its parameter if it takes one.
+type ModeChange struct {
+	Add   bool
+	Mode  byte
+	Param string
+}
+
+// Split a channel MODE into single changes, consuming parameters as
+// defined by the mode types.
+func (irc *Connection) parseChannelModes(modestring string, params []string) []ModeChange {
+	prefixModes, _ := irc.prefixes()
+	chanModes := irc.chanModes()
+	var changes []ModeChange
+	add := true
+	for i := 0; i < len(modestring); i++ {
+		mode := modestring[i]
+		switch mode {
+		case '+':
+			add = true
+			continue
+		case '-':
+			add = false
+			continue
+		}
+		change := ModeChange{Add: add, Mode: mode}
+		takesParam := strings.IndexByte(prefixModes, mode) > -1 ||
+			strings.IndexByte(chanModes[0], mode) > -1 ||
+			strings.IndexByte(chanModes[1], mode) > -1 ||
+			(add && strings.IndexByte(chanModes[2], mode) > -1)
+		if takesParam && len(params) > 0 {
+			change.Param = params[0]
+			params = params[1:]
+		}
+		changes = append(changes, change)
+	}
+	return changes
+}
+
+// Returns the channel membership modes and their prefix symbols, highest first.
+func (irc *Connection) prefixes() (modes, symbols string) {
+	irc.isupportMutex.Lock()
+	defer irc.isupportMutex.Unlock()
+	return irc.isupport.PrefixModes, irc.isupport.PrefixSymbols
+}
+
+// Returns the membership prefixes of channel operator status and higher,
+// those up to the one of mode o in PREFIX.
+func (irc *Connection) opSymbols() string {
+	modes, symbols := irc.prefixes()
+	if i := strings.IndexByte(modes, 'o'); i > -1 && i < len(symbols) {
+		return symbols[:i+1]
+	}
+	return ""
+}
+
+// Returns the channel mode letters by type: lists, always with parameter,
+// with parameter when set, and without parameter.
+func (irc *Connection) chanModes() [4]string {
+	irc.isupportMutex.Lock()
+	defer irc.isupportMutex.Unlock()
+	return irc.isupport.ChanModes
+}
+
+// Returns true if name is a channel name.
+func (irc *Connection) isChannel(name string) bool {
+	irc.isupportMutex.Lock()
+	defer irc.isupportMutex.Unlock()
+	return len(name) > 0 && strings.IndexByte(irc.isupport.ChanTypes, name[0]) > -1
+}
+
+// Split a name from a NAMES reply into its prefixes and the nick!user@host.
+func (irc *Connection) splitNamesPrefix(name string) (*Member, bool) {
+	_, symbols := irc.prefixes()
+	i := 0
+	for i < len(name) && strings.IndexByte(symbols, name[i]) > -1 {
+		i++
+	}
+	if i == len(name) {
+		return nil, false
+	}
+	m := &Member{Nick: name[i:], opSymbols: irc.opSymbols()}
+	for _, sym := range name[:i] {
+		m.Prefixes = irc.addPrefix(m.Prefixes, byte(sym))
+	}
+	if j, k := strings.Index(m.Nick, "!"), strings.Index(m.Nick, "@"); j > -1 && k > j {
+		m.User = m.Nick[j+1 : k]
+		m.Host = m.Nick[k+1:]
+		m.Nick = m.Nick[:j]
+	}
+	return m, true
+}
+
+// Add a prefix symbol, keeping the prefixes ordered from highest to lowest.
+func (irc *Connection) addPrefix(prefixes string, symbol byte) string {
+	if strings.IndexByte(prefixes, symbol) > -1 {
+		return prefixes
+	}
+	_, symbols := irc.prefixes()
+	var b strings.Builder
+	for i := 0; i < len(symbols); i++ {
+		if symbols[i] == symbol || strings.IndexByte(prefixes, symbols[i]) > -1 {
+			b.WriteByte(symbols[i])
+		}
+	}
+	return b.String()
+}
+
+func removePrefix(prefixes string, symbol byte) string {
+	return strings.Replace(prefixes, string(symbol), "", -1)
+}
+
+// Apply user mode changes like "+iw-x" to a mode string.
+func applyUserModes(modes, modestring string) string {
+	add := true
+	for i := 0; i < len(modestring); i++ {
+		switch mode := modestring[i]; mode {
+		case '+':
+			add = true
+		case '-':
+			add = false
+		default:
+			if add && strings.IndexByte(modes, mode) == -1 {
+				modes += string(mode)
+			} else if !add {
+				modes = strings.Replace(modes, string(mode), "", -1)
+			}
+		}
+	}
+	return modes
+}
+
+// Set up callbacks maintaining the state tracker.
+func (irc *Connection) setupStateCallbacks() {
+	irc.state = newState(irc)
+	s := irc.state
+
+	// 1: RPL_WELCOME. Start with a clean slate on every registration.
+	irc.AddCallback("001", func(e *Event) {
+		if irc.TrackState {
+			s.reset()
+		}
+	})
+
+	irc.AddCallback("JOIN", func(e *Event) {
+		if !irc.TrackState || len(e.Arguments) == 0 {
+			return
+		}
+		name := e.Arguments[0]
+		key := irc.CaseFold(name)
+		s.Lock()
+		defer s.Unlock()
+		if irc.EqualFold(e.Nick, irc.GetNick()) {
+			s.channels[key] = &Channel{
+				Name:    name,
+				Modes:   make(map[byte]string),
+				Members: make(map[string]*Member),
+			}
+		}
+		if ch, ok := s.channels[key]; ok {
+			ch.Members[irc.CaseFold(e.Nick)] = &Member{Nick: e.Nick, User: e.User, Host: e.Host, opSymbols: irc.opSymbols()}
+		}
+	})
+
+	irc.AddCallback("PART", func(e *Event) {
+		if !irc.TrackState || len(e.Arguments) == 0 {
+			return
+		}
+		s.Lock()
+		defer s.Unlock()
+		s.removeMember(e.Arguments[0], e.Nick)
+	})
+
+	irc.AddCallback("KICK", func(e *Event) {
+		if !irc.TrackState || len(e.Arguments) < 2 {
+			return
+		}
+		s.Lock()
+		defer s.Unlock()
+		s.removeMember(e.Arguments[0], e.Arguments[1])
+	})
+
+	irc.AddCallback("QUIT", func(e *Event) {
+		if !irc.TrackState {
+			return
+		}
+		s.Lock()
+		defer s.Unlock()
+		nick := irc.CaseFold(e.Nick)
+		for _, ch := range s.channels {
+			delete(ch.Members, nick)
+		}
+	})
+
+	irc.AddCallback("NICK", func(e *Event) {
+		if !irc.TrackState || len(e.Arguments) == 0 {
+			return
+		}
+		oldKey, newNick := irc.CaseFold(e.Nick), e.Message()
+		newKey := irc.CaseFold(newNick)
+		s.Lock()
+		defer s.Unlock()
+		for _, ch := range s.channels {
+			if member, ok := ch.Members[oldKey]; ok {
+				delete(ch.Members, oldKey)
+				member.Nick = newNick
+				ch.Members[newKey] = member
+			}
+		}
+	})
+
+	// 353: RPL_NAMREPLY "<me> <type> <channel> :[prefix]<nick> ..."
+	irc.AddCallback("353", func(e *Event) {
+		if !irc.TrackState || len(e.Arguments) < 4 {
+			return
+		}
+		key := irc.CaseFold(e.Arguments[2])
+		s.Lock()
+		defer s.Unlock()
+		if _, ok := s.channels[key]; !ok {
+			return
+		}
+		names, ok := s.names[key]
+		if !ok {
+			names = make(map[string]*Member)
+			s.names[key] = names
+		}
+		for _, n := range strings.Fields(e.Message()) {
+			if m, ok := irc.splitNamesPrefix(n); ok {
+				names[irc.CaseFold(m.Nick)] = m
+			}
+		}
+	})
+
+	// 366: RPL_ENDOFNAMES "<me> <channel> :End of NAMES list"
+	irc.AddCallback("366", func(e *Event) {
+		if !irc.TrackState || len(e.Arguments) < 2 {
+			return
+		}
+		key := irc.CaseFold(e.Arguments[1])
+		s.Lock()
+		defer s.Unlock()
+		names, ok := s.names[key]
+		delete(s.names, key)
+		ch, joined := s.channels[key]
+		if !ok || !joined {
+			return
+		}
+		for nick, m := range names {
+			// Keep user and host we learned from JOINs
+			if old, ok := ch.Members[nick]; ok && m.Host == "" {
+				m.User, m.Host = old.User, old.Host
+			}
+		}
+		ch.Members = names
+	})
+
+	// 332: RPL_TOPIC "<me> <channel> :<topic>"
+	irc.AddCallback("332", func(e *Event) {
+		if !irc.TrackState || len(e.Arguments) < 3 {
+			return
+		}
+		s.setTopic(e.Arguments[1], e.Message())
+	})
+
+	irc.AddCallback("TOPIC", func(e *Event) {
+		if !irc.TrackState || len(e.Arguments) < 2 {
+			return
+		}
+		s.setTopic(e.Arguments[0], e.Message())
+	})
+
+	// 324: RPL_CHANNELMODEIS "<me> <channel> <modes> [<params>]"
+	irc.AddCallback("324", func(e *Event) {
+		if !irc.TrackState || len(e.Arguments) < 3 {
+			return
+		}
+		s.Lock()
+		defer s.Unlock()
+		if ch, ok := s.channels[irc.CaseFold(e.Arguments[1])]; ok {
+			ch.Modes = make(map[byte]string)
+			s.applyChannelModes(ch, irc.parseChannelModes(e.Arguments[2], e.Arguments[3:]))
+		}
+	})
+
+	// 221: RPL_UMODEIS "<me> <modes>"
+	irc.AddCallback("221", func(e *Event) {
+		if !irc.TrackState || len(e.Arguments) < 2 {
+			return
+		}
+		s.Lock()
+		s.userModes = applyUserModes("", e.Arguments[1])
+		s.Unlock()
+	})
+
+	irc.AddCallback("MODE", func(e *Event) {
+		if !irc.TrackState || len(e.Arguments) < 2 {
+			return
+		}
+		target := e.Arguments[0]
+		s.Lock()
+		defer s.Unlock()
+		if !irc.isChannel(target) {
+			if irc.EqualFold(target, irc.GetNick()) {
+				s.userModes = applyUserModes(s.userModes, e.Arguments[1])
+			}
+			return
+		}
+		if ch, ok := s.channels[irc.CaseFold(target)]; ok {
+			s.applyChannelModes(ch, irc.parseChannelModes(e.Arguments[1], e.Arguments[2:]))
+		}
+	})
+}
+
+// Must be called with the lock held.
+func (s *State) removeMember(channel, nick string) {
+	channel = s.irc.CaseFold(channel)
+	if s.irc.EqualFold(nick, s.irc.GetNick()) {
+		delete(s.channels, channel)
+		delete(s.names, channel)
+		return
+	}
+	if ch, ok := s.channels[channel]; ok {
+		delete(ch.Members, s.irc.CaseFold(nick))
+	}
+}
+
+func (s *State) setTopic(channel, topic string) {
+	s.Lock()
+	defer s.Unlock()
+	if ch, ok := s.channels[s.irc.CaseFold(channel)]; ok {
+		ch.Topic = topic
+	}
+}
+
+// Must be called with the lock held.
+func (s *State) applyChannelModes(ch *Channel, changes []ModeChange) {
+	prefixModes, symbols := s.irc.prefixes()
+	listModes := s.irc.chanModes()[0]
+	for _, c := range changes {
+		if i := strings.IndexByte(prefixModes, c.Mode); i > -1 {
+			if member, ok := ch.Members[s.irc.CaseFold(c.Param)]; ok {
+				if c.Add {
+					member.Prefixes = s.irc.addPrefix(member.Prefixes, symbols[i])
+				} else {
+					member.Prefixes = removePrefix(member.Prefixes, symbols[i])
+				}
+			}
+			continue
+		}
+		if strings.IndexByte(listModes, c.Mode) > -1 {
+			continue
+		}
+		if c.Add {
+			ch.Modes[c.Mode] = c.Param
+		} else {
+			delete(ch.Modes, c.Mode)
+		}
+	}
+}
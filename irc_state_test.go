@@ -0,0 +1,118 @@
+package irc
+
+import (
+	"testing"
+)
+
+func feed(t *testing.T, irccon *Connection, lines ...string) {
+	for _, line := range lines {
+		event, err := parseToEvent(line)
+		if err != nil {
+			t.Fatalf("Parse %q failed: %s", line, err)
+		}
+		event.Connection = irccon
+		irccon.RunCallbacks(event)
+	}
+}
+
+func TestStateDisabled(t *testing.T) {
+	irccon := IRC("go-eventirc", "go-eventirc")
+	if irccon.State() != nil {
+		t.Fatal("State() returned a tracker without TrackState")
+	}
+}
+
+func TestStateJoinNames(t *testing.T) {
+	irccon := IRC("go-eventirc", "go-eventirc")
+	irccon.TrackState = true
+	feed(t, irccon,
+		":go-eventirc!~go@host JOIN #test",
+		":server 332 go-eventirc #test :the topic",
+		":server 353 go-eventirc = #test :go-eventirc @op +voice @+both",
+		":server 366 go-eventirc #test :End of /NAMES list.",
+		":server 324 go-eventirc #test +ntlk 10 secret",
+	)
+	s := irccon.State()
+
+	channels := s.Channels()
+	if len(channels) != 1 || channels[0] != "#test" {
+		t.Fatalf("Channels() = %v", channels)
+	}
+	ch, ok := s.Channel("#test")
+	if !ok {
+		t.Fatal("Channel #test not tracked")
+	}
+	if ch.Topic != "the topic" {
+		t.Errorf("Topic = %q", ch.Topic)
+	}
+	if len(ch.Members) != 4 {
+		t.Errorf("Expected 4 members, got %d", len(ch.Members))
+	}
+	if ch.Members["go-eventirc"].Host != "host" {
+		t.Error("Host from JOIN lost after NAMES")
+	}
+	if !ch.Members["op"].IsOp() || ch.Members["voice"].IsOp() || !ch.Members["voice"].IsVoice() {
+		t.Error("Member prefixes not parsed")
+	}
+	if ch.Members["both"].Prefixes != "@+" {
+		t.Errorf("Prefixes = %q", ch.Members["both"].Prefixes)
+	}
+	if ch.Modes['l'] != "10" || ch.Modes['k'] != "secret" {
+		t.Errorf("Modes = %v", ch.Modes)
+	}
+	if _, ok := ch.Modes['n']; !ok {
+		t.Errorf("Mode n not set")
+	}
+
+	// Snapshots are not modified by later events
+	feed(t, irccon, ":someone!~u@h JOIN #test")
+	if _, ok := ch.Members["someone"]; ok {
+		t.Error("Snapshot was modified")
+	}
+	if !s.IsOn("#test", "someone") {
+		t.Error("JOIN not tracked")
+	}
+}
+
+func TestStateChanges(t *testing.T) {
+	irccon := IRC("go-eventirc", "go-eventirc")
+	irccon.TrackState = true
+	feed(t, irccon,
+		":go-eventirc!~go@host JOIN #test",
+		":go-eventirc!~go@host JOIN #other",
+		":a!~a@h JOIN #test",
+		":b!~b@h JOIN #test",
+		":b!~b@h JOIN #other",
+		":op!~op@h MODE #test +ov-n a b",
+		":a!~a@h NICK c",
+		":b!~b@h QUIT :bye",
+		":op!~op@h TOPIC #test :new topic",
+		":go-eventirc MODE go-eventirc :+iw",
+		":go-eventirc MODE go-eventirc :-w+x",
+	)
+	s := irccon.State()
+	m, ok := s.Member("#test", "c")
+	if !ok {
+		t.Fatal("Nick change not tracked")
+	}
+	if m.Prefixes != "@" {
+		t.Errorf("Prefixes = %q", m.Prefixes)
+	}
+	if s.IsOn("#test", "a") || s.IsOn("#test", "b") || s.IsOn("#other", "b") {
+		t.Error("Members not removed")
+	}
+	if ch, _ := s.Channel("#test"); ch.Topic != "new topic" {
+		t.Errorf("Topic = %q", ch.Topic)
+	}
+	if s.UserModes() != "ix" {
+		t.Errorf("UserModes() = %q", s.UserModes())
+	}
+
+	feed(t, irccon,
+		":op!~op@h KICK #test go-eventirc :out",
+		":go-eventirc!~go@host PART #other",
+	)
+	if len(s.Channels()) != 0 {
+		t.Errorf("Channels() = %v", s.Channels())
+	}
+}
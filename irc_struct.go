@@ -25,25 +25,39 @@ type Connection struct {
 	Password         string
 	UseTLS           bool
 	UseSASL          bool
-	RequestCaps      []string
-	AcknowledgedCaps []string
+	UseSTS           bool     //Honor STS policies: upgrade to TLS and refuse plaintext connections
+	STSStore         STSStore //Keeps STS policies. nil uses DefaultSTSStore().
+	RequestCaps      []string //Capabilities to request, see also RequestCap
+	AcknowledgedCaps []string //Capabilities the server acknowledged, see HasCap
 	SASLLogin        string
 	SASLPassword     string
 	SASLMech         string
+	SASLMechanism    SASLMechanism     //Overrides SASLMech, SASLLogin and SASLPassword
+	SASLFailure      SASLFailurePolicy //What to do if SASL fails while connecting. Defaults to SASLAbort.
 	TLSConfig        *tls.Config
+	CertPinning      *CertPinning //Verify the server certificate by its key instead of the CA chain
 	Version          string
 	Timeout          time.Duration
 	CallbackTimeout  time.Duration
 	PingFreq         time.Duration
 	KeepAlive        time.Duration
 	Server           string
+	Servers          []Endpoint //Servers to try in turn when connecting to ""
+	RandomizeServers bool       //Try Servers in random order
+	FollowRedirects  bool       //Reconnect to the server given in RPL_BOUNCE (010)
 	Encoding         encoding.Encoding
+	TrackState       bool            //Maintain channel and user state, see State().
+	FloodControl     *FloodControl   //Rate limit for outgoing lines. nil disables flood control.
+	ReconnectPolicy  ReconnectPolicy //Decides if and when Loop reconnects. Defaults to a constant 60 s.
+	AutoJoin         []string        //Channels to join after registering, "#channel" or "#channel key".
+	AutoRejoin       bool            //Rejoin channels, restore away status and user modes after registering.
+	Dialer           Dialer          //Opens the connection. nil connects directly or through the proxy in ALL_PROXY.
 
 	RealName string // The real name we want to display.
 	// If zero-value defaults to the user.
 
 	socket net.Conn
-	pwrite chan string
+	pwrite [numPriorities]chan string
 	end    chan struct{}
 
 	nick        string //The nickname we want.
@@ -64,6 +78,42 @@ type Connection struct {
 	quit    bool //User called Quit, do not reconnect.
 
 	idCounter int // assign unique IDs to callbacks
+
+	state         *State
+	isupport      *ISupport
+	isupportMutex sync.Mutex
+	caps          map[string]string //Capabilities offered by the server
+	capLSLines    []string          //Capabilities of CAP LS lines to come
+	capLS         chan map[string]string
+	capReplies    chan bool               //Receives one value per capability ACKed or NAKed
+	capNames      []string                //Capabilities of RequestCap, in order
+	capHandlers   map[string][]CapHandler //Handlers of RequestCap by capability
+	capPending    int                     //Capabilities of the background negotiation not answered yet
+	capDone       chan struct{}           //Set while negotiating defaultCaps without holding up registration, closed when done
+	capsMutex     sync.Mutex
+	prefix        string //Our nick!user@host as seen by others, if known
+	prefixMutex   sync.Mutex
+	failover      bool //Connected using Servers
+	redirected    bool //Connected to the server of a redirect
+	endpoint      Endpoint
+	redirect      *Endpoint
+	endpointMutex sync.Mutex
+	stsPolicies   STSStore //STSStore or the default store, set when connecting
+
+	joined        map[string]string        //Channels we are in on this connection, by casefolded name
+	rejoin        map[string]joinedChannel //Channels to rejoin, by casefolded name
+	joinKeys      map[string]string        //Keys passed to Join, until the JOIN arrives
+	awayMessage   string
+	userModes     string //User modes we set with Mode
+	restored      bool   //State was restored on this connection
+	rejoinPending map[string]string
+	rejoinFailed  []string
+	rejoinTimer   *time.Timer
+	joinedMutex   sync.Mutex
+
+	authenticating bool   //Reauthenticate is running
+	account        string //Account we are logged in to, from RPL_LOGGEDIN
+	identify       bool   //Identify with NickServ after registering
 }
 
 // A struct to represent an event.
@@ -76,6 +126,7 @@ type Event struct {
 	User       string //<usr>
 	Arguments  []string
 	Tags       map[string]string
+	Time       time.Time //When the server sent the message (IRCv3 server-time), or when we received it
 	Connection *Connection
 	Ctx        context.Context
 }
@@ -0,0 +1,183 @@
+package irc
+
+import (
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A Strict Transport Security policy: connect to the host only with TLS on
+// Port until Expires. See https://ircv3.net/specs/extensions/sts
+type STSPolicy struct {
+	Port    string
+	Expires time.Time
+}
+
+// An STSStore keeps STS policies by host name between connections and
+// program runs.
+type STSStore interface {
+	// Returns the policy for host, if any. Expired policies may be returned.
+	Get(host string) (STSPolicy, bool)
+	Set(host string, policy STSPolicy) error
+	Delete(host string) error
+}
+
+// Stores STS policies in a JSON file.
+type FileSTSStore struct {
+	Path string
+	mu   sync.Mutex
+}
+
+// Returns a store in the user's configuration directory. Fails if there is
+// none, set Path then.
+func DefaultSTSStore() (*FileSTSStore, error) {
+	path, err := configPath("sts.json")
+	if err != nil {
+		return nil, err
+	}
+	return &FileSTSStore{Path: path}, nil
+}
+
+func (s *FileSTSStore) load() (map[string]STSPolicy, error) {
+	policies := make(map[string]STSPolicy)
+	return policies, loadJSON(s.Path, &policies)
+}
+
+func (s *FileSTSStore) Get(host string) (STSPolicy, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	policies, err := s.load()
+	if err != nil {
+		return STSPolicy{}, false
+	}
+	policy, ok := policies[strings.ToLower(host)]
+	return policy, ok
+}
+
+func (s *FileSTSStore) Set(host string, policy STSPolicy) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	policies, err := s.load()
+	if err != nil {
+		return err
+	}
+	policies[strings.ToLower(host)] = policy
+	return saveJSON(s.Path, policies)
+}
+
+func (s *FileSTSStore) Delete(host string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	policies, err := s.load()
+	if err != nil {
+		return err
+	}
+	if _, ok := policies[strings.ToLower(host)]; !ok {
+		return nil
+	}
+	delete(policies, strings.ToLower(host))
+	return saveJSON(s.Path, policies)
+}
+
+// Returned by ConnectConn when the server requires TLS by its STS policy.
+// Connect to its TLS port instead.
+var ErrSTSUpgrade = errors.New("STS policy requires TLS")
+
+// Returned by negotiateCaps when a plaintext connection has to be
+// replaced with a TLS one.
+type stsUpgrade struct {
+	Endpoint Endpoint
+}
+
+func (u *stsUpgrade) Error() string {
+	return "STS upgrade to " + u.Endpoint.Server
+}
+
+// Returns the host name STS policies of the endpoint are stored under, or
+// "" if STS does not apply to it.
+func stsHost(ep Endpoint) string {
+	host := serverHost(ep.Server)
+	if net.ParseIP(host) != nil {
+		return ""
+	}
+	return host
+}
+
+// Apply a stored STS policy to the endpoint, switching to TLS on the port
+// of the policy. Plaintext WebSocket connections are refused instead.
+func (irc *Connection) stsEndpoint(ep Endpoint) (Endpoint, error) {
+	if !irc.UseSTS || ep.UseTLS {
+		return ep, nil
+	}
+	host := stsHost(ep)
+	if host == "" {
+		return ep, nil
+	}
+	policy, ok := irc.stsPolicies.Get(host)
+	if !ok {
+		return ep, nil
+	}
+	if time.Now().After(policy.Expires) {
+		irc.stsPolicies.Delete(host)
+		return ep, nil
+	}
+	if isWebSocketURL(ep.Server) {
+		return ep, errors.New("STS policy forbids plaintext connections to " + host)
+	}
+	irc.Log.Printf("STS policy for %s, connecting with TLS on port %s\n", host, policy.Port)
+	ep.UseTLS = true
+	ep.Server = net.JoinHostPort(host, policy.Port)
+	return ep, nil
+}
+
+// Act on the value of the sts capability advertised by the server on a
+// connection to ep. Returns an *stsUpgrade if the connection has to be
+// replaced with a TLS one.
+func (irc *Connection) handleSTS(ep Endpoint, value string) error {
+	host := stsHost(ep)
+	if host == "" || isWebSocketURL(ep.Server) {
+		return nil
+	}
+	params := make(map[string]string)
+	for _, param := range strings.Split(value, ",") {
+		kv := strings.SplitN(param, "=", 2)
+		if len(kv) == 2 {
+			params[kv[0]] = kv[1]
+		} else {
+			params[kv[0]] = ""
+		}
+	}
+
+	if !ep.UseTLS {
+		port, err := strconv.Atoi(params["port"])
+		if err != nil || port <= 0 || port > 65535 {
+			return nil
+		}
+		ep.UseTLS = true
+		ep.Server = net.JoinHostPort(host, params["port"])
+		return &stsUpgrade{ep}
+	}
+
+	duration, ok := params["duration"]
+	if !ok {
+		return nil
+	}
+	seconds, err := strconv.ParseInt(duration, 10, 64)
+	if err != nil || seconds < 0 {
+		return nil
+	}
+	if seconds == 0 {
+		err = irc.stsPolicies.Delete(host)
+	} else {
+		_, port, _ := net.SplitHostPort(ep.Server)
+		policy := STSPolicy{Port: port, Expires: time.Now().Add(time.Duration(seconds) * time.Second)}
+		err = irc.stsPolicies.Set(host, policy)
+	}
+	if err != nil {
+		irc.Log.Printf("Storing STS policy for %s failed: %s\n", host, err)
+	}
+	return nil
+}
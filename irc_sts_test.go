@@ -0,0 +1,185 @@
+package irc
+
+import (
+	"bufio"
+	"crypto/tls"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Serve an IRC client on conn: report each line received on lines, if not
+// nil, and answer it with the lines script returns.
+func scriptConn(conn net.Conn, lines chan<- string, script func(line string) []string) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		line = strings.TrimSpace(line)
+		if lines != nil {
+			lines <- line
+		}
+		for _, reply := range script(line) {
+			conn.Write([]byte(reply + "\r\n"))
+		}
+	}
+}
+
+// Run a scripted IRC server on a local port, see scriptConn.
+func scriptServer(t *testing.T, lines chan<- string, script func(line string) []string) net.Listener {
+	return localServer(t, func(conn net.Conn) {
+		scriptConn(conn, lines, script)
+	})
+}
+
+// Serve connections from l, answering CAP LS with caps and reporting the
+// lines received.
+func capServer(l net.Listener, caps string, lines chan<- string) {
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go scriptConn(conn, lines, func(line string) []string {
+				if strings.HasPrefix(line, "CAP LS") {
+					return []string{":server CAP * LS :multi-prefix " + caps}
+				}
+				return nil
+			})
+		}
+	}()
+}
+
+// Wait for a line starting with prefix.
+func expectLine(t *testing.T, lines <-chan string, prefix string) {
+	for {
+		select {
+		case line := <-lines:
+			if strings.HasPrefix(line, prefix) {
+				return
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("No %s received", prefix)
+		}
+	}
+}
+
+// Create a temporary directory, removed by calling cleanup.
+func tempDir(t *testing.T) (dir string, cleanup func()) {
+	dir, err := ioutil.TempDir("", "go-ircevent")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir, func() { os.RemoveAll(dir) }
+}
+
+func TestFileSTSStore(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	store := &FileSTSStore{Path: filepath.Join(dir, "sts", "sts.json")}
+
+	if _, ok := store.Get("irc.example.org"); ok {
+		t.Fatal("Policy in empty store")
+	}
+	expires := time.Now().Add(time.Hour).Round(time.Second)
+	if err := store.Set("IRC.example.org", STSPolicy{Port: "6697", Expires: expires}); err != nil {
+		t.Fatal(err)
+	}
+	reopened := &FileSTSStore{Path: store.Path}
+	policy, ok := reopened.Get("irc.example.org")
+	if !ok || policy.Port != "6697" || !policy.Expires.Equal(expires) {
+		t.Fatalf("Get() = %+v, %v", policy, ok)
+	}
+	if err := reopened.Delete("irc.example.org"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := store.Get("irc.example.org"); ok {
+		t.Fatal("Policy not deleted")
+	}
+}
+
+func TestSTSUpgrade(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	store := &FileSTSStore{Path: filepath.Join(dir, "sts", "sts.json")}
+
+	tlsListener, _ := localTLSListener(t)
+	defer tlsListener.Close()
+	_, tlsPort, _ := net.SplitHostPort(tlsListener.Addr().String())
+	tlsLines := make(chan string, 100)
+	capServer(tlsListener, "sts=duration=3600,port=1", tlsLines)
+
+	plainListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer plainListener.Close()
+	_, plainPort, _ := net.SplitHostPort(plainListener.Addr().String())
+	plainLines := make(chan string, 100)
+	capServer(plainListener, "sts=port="+tlsPort+",duration=999999", plainLines)
+
+	irccon := IRC("go-eventirc", "go-eventirc")
+	debugTest(irccon)
+	irccon.UseSTS = true
+	irccon.STSStore = store
+	irccon.TLSConfig = &tls.Config{InsecureSkipVerify: true}
+	if err := irccon.Connect("localhost:" + plainPort); err != nil {
+		t.Fatal(err)
+	}
+	expectLine(t, plainLines, "CAP LS 302")
+	expectLine(t, tlsLines, "CAP END")
+	if ep := irccon.Endpoint(); !ep.UseTLS || ep.Server != "localhost:"+tlsPort {
+		t.Errorf("Connected to %+v", ep)
+	}
+	policy, ok := store.Get("localhost")
+	if !ok || policy.Port != tlsPort || time.Until(policy.Expires) > time.Hour {
+		t.Errorf("Stored policy %+v, %v", policy, ok)
+	}
+	irccon.shutdown()
+
+	// The stored policy upgrades the next connection right away
+	irccon = IRC("go-eventirc", "go-eventirc")
+	debugTest(irccon)
+	irccon.UseSTS = true
+	irccon.STSStore = store
+	irccon.TLSConfig = &tls.Config{InsecureSkipVerify: true}
+	if err := irccon.Connect("localhost:" + plainPort); err != nil {
+		t.Fatal(err)
+	}
+	defer irccon.shutdown()
+	expectLine(t, tlsLines, "CAP LS 302")
+	select {
+	case line := <-plainLines:
+		t.Errorf("Plaintext server got %q", line)
+	default:
+	}
+
+	if _, err := irccon.stsEndpoint(Endpoint{Server: "ws://localhost/irc"}); err == nil {
+		t.Error("Plaintext WebSocket allowed despite STS policy")
+	}
+
+	// A connection passed in cannot be upgraded
+	conn, err := net.Dial("tcp", plainListener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	irccon = IRC("go-eventirc", "go-eventirc")
+	debugTest(irccon)
+	irccon.UseSTS = true
+	irccon.STSStore = store
+	irccon.Server = "localhost:" + plainPort
+	if err := irccon.ConnectConn(conn); err != ErrSTSUpgrade {
+		t.Errorf("ConnectConn() = %v", err)
+	}
+	if irccon.Connected() {
+		t.Error("Still connected after STS upgrade")
+	}
+}
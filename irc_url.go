@@ -0,0 +1,111 @@
+package irc
+
+import (
+	"errors"
+	"net"
+	"net/url"
+	"strings"
+)
+
+// Connection settings given by an irc:// or ircs:// URL.
+type ServerURL struct {
+	Endpoint          //Server with the default port if none was given, TLS for ircs://, Password
+	Nick     string   //From the user part, may be empty
+	Channels []string //Channels to join, "#channel" or "#channel key"
+}
+
+// Returns true if server looks like an irc:// or ircs:// URL.
+func isIRCURL(server string) bool {
+	s := strings.ToLower(server)
+	return strings.HasPrefix(s, "irc://") || strings.HasPrefix(s, "ircs://")
+}
+
+// Parse a URL of the form
+//
+//	irc[s]://[nick[:password]@]host[:port][/channel[,channel...]]
+//
+// The port defaults to 6667 for irc:// and 6697 for ircs://, which also
+// enables TLS. The password is the server password. Channels without a
+// prefix get a #, as the # of the first channel starts a URL fragment
+// otherwise. A channel key can follow its channel after a space (%20).
+func ParseURL(rawurl string) (*ServerURL, error) {
+	if !isIRCURL(rawurl) {
+		return nil, errors.New("not an irc:// or ircs:// URL")
+	}
+	scheme := strings.ToLower(rawurl[:strings.Index(rawurl, ":")])
+	rest := rawurl[len(scheme)+len("://"):]
+
+	// Split off the channels before url.Parse takes # for a fragment
+	authority, path := rest, ""
+	if i := strings.Index(rest, "/"); i > -1 {
+		authority, path = rest[:i], rest[i+1:]
+	}
+	u, err := url.Parse(scheme + "://" + authority)
+	if err != nil {
+		return nil, err
+	}
+	if u.Hostname() == "" {
+		return nil, errors.New("hostname is missing")
+	}
+
+	s := &ServerURL{Endpoint: Endpoint{UseTLS: scheme == "ircs"}}
+	port := u.Port()
+	if port == "" {
+		port = "6667"
+		if s.UseTLS {
+			port = "6697"
+		}
+	}
+	s.Server = net.JoinHostPort(u.Hostname(), port)
+	if u.User != nil {
+		s.Nick = u.User.Username()
+		s.Password, _ = u.User.Password()
+	}
+
+	path, err = url.PathUnescape(path)
+	if err != nil {
+		return nil, err
+	}
+	for _, channel := range strings.Split(path, ",") {
+		channel = strings.TrimSpace(channel)
+		if channel == "" {
+			continue
+		}
+		if !strings.ContainsAny(channel[:1], "#&+!") {
+			channel = "#" + channel
+		}
+		s.Channels = append(s.Channels, channel)
+	}
+	return s, nil
+}
+
+// Take over the settings of an irc:// or ircs:// URL.
+func (irc *Connection) applyURL(s *ServerURL) {
+	irc.UseTLS = s.UseTLS
+	if s.Password != "" {
+		irc.Password = s.Password
+	}
+	if s.Nick != "" {
+		irc.nick = s.Nick
+		irc.nickcurrent = s.Nick
+	}
+	if len(s.Channels) > 0 {
+		irc.AutoJoin = s.Channels
+	}
+}
+
+// Join the AutoJoin channels, except those AutoRejoin takes care of.
+func (irc *Connection) autoJoin() {
+	for _, channel := range irc.AutoJoin {
+		name := strings.Fields(channel)
+		if len(name) == 0 {
+			continue
+		}
+		irc.joinedMutex.Lock()
+		_, rejoin := irc.rejoin[irc.CaseFold(name[0])]
+		irc.joinedMutex.Unlock()
+		if !irc.AutoRejoin || !rejoin {
+			irc.Join(channel)
+		}
+	}
+}
@@ -0,0 +1,127 @@
+package irc
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+// WebSocket subprotocols of https://ircv3.net/specs/extensions/websocket
+const (
+	wsBinaryProtocol = "binary.ircv3.net"
+	wsTextProtocol   = "text.ircv3.net"
+)
+
+// Returns true if server is a ws:// or wss:// URL.
+func isWebSocketURL(server string) bool {
+	s := strings.ToLower(server)
+	return strings.HasPrefix(s, "ws://") || strings.HasPrefix(s, "wss://")
+}
+
+// Open a WebSocket connection to a ws:// or wss:// URL. The underlying
+// connection is dialed like any other, wss:// adds TLS with TLSConfig.
+func (irc *Connection) dialWebSocket(ctx context.Context, rawurl string) (net.Conn, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, err
+	}
+	secure := strings.ToLower(u.Scheme) == "wss"
+	port, origin := u.Port(), "http://"+u.Host
+	if secure {
+		origin = "https://" + u.Host
+	}
+	if port == "" {
+		port = "80"
+		if secure {
+			port = "443"
+		}
+	}
+
+	conn, err := irc.dial(ctx, net.JoinHostPort(u.Hostname(), port))
+	if err != nil {
+		return nil, err
+	}
+	if secure {
+		tlsConn := tls.Client(conn, irc.tlsConfig(u.Hostname()))
+		if err = irc.handshake(ctx, tlsConn); err != nil {
+			return nil, err
+		}
+		conn = tlsConn
+	}
+
+	config, err := websocket.NewConfig(rawurl, origin)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	config.Protocol = []string{wsBinaryProtocol, wsTextProtocol}
+
+	conn.SetDeadline(time.Now().Add(irc.Timeout))
+	stop := closeOnDone(ctx, conn)
+	ws, err := websocket.NewClient(config, conn)
+	stop()
+	if err != nil {
+		conn.Close()
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, err
+	}
+	var zero time.Time
+	conn.SetDeadline(zero)
+
+	binary := len(config.Protocol) == 1 && config.Protocol[0] == wsBinaryProtocol
+	return &wsConn{Conn: ws, binary: binary}, nil
+}
+
+// A WebSocket connection carrying one IRC line per message, adapted to
+// the stream of \r\n terminated lines the read and write loops expect.
+type wsConn struct {
+	*websocket.Conn
+	binary bool //binary.ircv3.net, text.ircv3.net otherwise
+	rbuf   []byte
+	wbuf   []byte
+}
+
+func (c *wsConn) Read(p []byte) (int, error) {
+	for len(c.rbuf) == 0 {
+		var msg []byte
+		if err := websocket.Message.Receive(c.Conn, &msg); err != nil {
+			return 0, err
+		}
+		msg = bytes.TrimRight(msg, "\r\n")
+		if len(msg) > 0 {
+			c.rbuf = append(msg, '\r', '\n')
+		}
+	}
+	n := copy(p, c.rbuf)
+	c.rbuf = c.rbuf[n:]
+	return n, nil
+}
+
+func (c *wsConn) Write(p []byte) (int, error) {
+	c.wbuf = append(c.wbuf, p...)
+	for {
+		i := bytes.IndexByte(c.wbuf, '\n')
+		if i < 0 {
+			return len(p), nil
+		}
+		line := bytes.TrimRight(c.wbuf[:i], "\r")
+		var err error
+		if c.binary {
+			err = websocket.Message.Send(c.Conn, line)
+		} else {
+			err = websocket.Message.Send(c.Conn, string(line))
+		}
+		c.wbuf = c.wbuf[i+1:]
+		if err != nil {
+			return 0, err
+		}
+	}
+}
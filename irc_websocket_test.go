@@ -0,0 +1,95 @@
+package irc
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+// WebSocket IRC server accepting protocol, which checks the registration
+// and welcomes the client.
+func wsServer(t *testing.T, protocol string, secure bool, received chan<- string) *httptest.Server {
+	server := websocket.Server{
+		Handshake: func(config *websocket.Config, r *http.Request) error {
+			for _, p := range config.Protocol {
+				if p == protocol {
+					config.Protocol = []string{protocol}
+					return nil
+				}
+			}
+			config.Protocol = nil
+			return nil
+		},
+		Handler: func(ws *websocket.Conn) {
+			defer ws.Close()
+			for i := 0; i < 3; i++ {
+				var msg []byte
+				if err := websocket.Message.Receive(ws, &msg); err != nil {
+					return
+				}
+				received <- string(msg)
+			}
+			if protocol == wsBinaryProtocol {
+				websocket.Message.Send(ws, []byte(":server 001 go-eventirc :Welcome"))
+			} else {
+				websocket.Message.Send(ws, ":server 001 go-eventirc :Welcome")
+			}
+			var msg []byte
+			websocket.Message.Receive(ws, &msg)
+		},
+	}
+	if secure {
+		return httptest.NewTLSServer(server)
+	}
+	return httptest.NewServer(server)
+}
+
+func TestWebSocket(t *testing.T) {
+	for _, test := range []struct {
+		protocol string
+		secure   bool
+	}{
+		{wsTextProtocol, false},
+		{wsBinaryProtocol, false},
+		{wsBinaryProtocol, true},
+	} {
+		received := make(chan string, 3)
+		s := wsServer(t, test.protocol, test.secure, received)
+
+		irccon := IRC("go-eventirc", "go-eventirc")
+		debugTest(irccon)
+		irccon.TLSConfig = &tls.Config{InsecureSkipVerify: true}
+		registered := make(chan struct{})
+		irccon.AddCallback("REGISTERED", func(e *Event) { close(registered) })
+		url := strings.Replace(s.URL, "http", "ws", 1) + "/irc"
+		if err := irccon.Connect(url); err != nil {
+			t.Fatalf("%s: %s", url, err)
+		}
+
+		for _, expected := range []string{"CAP LS 302", "NICK go-eventirc", "USER go-eventirc 0.0.0.0 0.0.0.0 :go-eventirc"} {
+			select {
+			case msg := <-received:
+				if msg != expected {
+					t.Errorf("%s %s: server got %q", test.protocol, url, msg)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatalf("%s %s: nothing received", test.protocol, url)
+			}
+		}
+		select {
+		case <-registered:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s %s: not registered", test.protocol, url)
+		}
+		if wc, ok := irccon.socket.(*wsConn); !ok || wc.binary != (test.protocol == wsBinaryProtocol) {
+			t.Errorf("%s %s: wrong framing", test.protocol, url)
+		}
+		irccon.shutdown()
+		s.Close()
+	}
+}